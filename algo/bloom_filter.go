@@ -1,75 +1,177 @@
 package algo
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash/fnv"
+	"math"
+	"strings"
 )
 
+// Number of hashes of filters created with a fixed size
+const DEFAULT_BLOOM_HASHES = 3
+
+const MAX_BLOOM_HASHES = 30
+
+// Filters read from the text encoding set their bits with three salted FNV
+// hashes. They keep doing so, marked by this hash count, so that they still
+// match the keys of the tables they were built for.
+const LEGACY_BLOOM_HASHES = 0
+
 type BloomFilter struct {
-	bits []bool
-	size int
+	bits   []uint64
+	size   uint64 // Number of bits
+	hashes int
 }
 
 func NewEmptyBloomFilter(size int) *BloomFilter {
 	if size <= 0 {
 		size = 10000 // Default size
 	}
+	return NewBloomFilter(size, DEFAULT_BLOOM_HASHES)
+}
+
+// NewBloomFilter returns a filter of size bits that sets hashes bits per key.
+func NewBloomFilter(size int, hashes int) *BloomFilter {
 	return &BloomFilter{
-		bits: make([]bool, size),
-		size: size,
+		bits:   make([]uint64, (size+63)/64),
+		size:   uint64(size),
+		hashes: hashes,
 	}
 }
 
-func (bf *BloomFilter) hash1(data string) int {
-	h := fnv.New32a()
-	h.Write([]byte(data))
-	return int(h.Sum32()) % bf.size
+// NewBloomFilterForKeys sizes a filter for keys keys at bitsPerKey bits each
+// and picks the number of hashes with the lowest false positive rate for it,
+// about 1% at 10 bits per key.
+func NewBloomFilterForKeys(keys int, bitsPerKey int) *BloomFilter {
+	bitsPerKey = max(bitsPerKey, 1)
+	hashes := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	hashes = min(max(hashes, 1), MAX_BLOOM_HASHES)
+	// Tiny filters would be saturated by a few keys
+	return NewBloomFilter(max(keys*bitsPerKey, 64), hashes)
 }
 
-func (bf *BloomFilter) hash2(data string) int {
-	h := fnv.New32a()
-	h.Write([]byte(data + "salt"))
-	return int(h.Sum32()) % bf.size
+// Size returns the number of bits of the filter.
+func (bf *BloomFilter) Size() int {
+	return int(bf.size)
 }
 
-func (bf *BloomFilter) hash3(data string) int {
-	h := fnv.New32a()
-	h.Write([]byte("prefix" + data))
-	return int(h.Sum32()) % bf.size
+// Hashes returns the number of bits set per key.
+func (bf *BloomFilter) Hashes() int {
+	return bf.hashes
 }
 
 func (bf *BloomFilter) Add(item string) {
-	bf.bits[bf.hash1(item)] = true
-	bf.bits[bf.hash2(item)] = true
-	bf.bits[bf.hash3(item)] = true
+	bf.probe(item, func(bit uint64) bool {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
 }
 
 func (bf *BloomFilter) Contains(item string) bool {
-	return bf.bits[bf.hash1(item)] &&
-		bf.bits[bf.hash2(item)] &&
-		bf.bits[bf.hash3(item)]
+	return bf.probe(item, func(bit uint64) bool {
+		return bf.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+// probe calls visit with every bit of item until visit returns false, and
+// reports whether it never did. The bits come from double hashing: the i-th
+// one is h1 + i*h2, taken from the two halves of a single 64-bit hash.
+func (bf *BloomFilter) probe(item string, visit func(bit uint64) bool) bool {
+	if bf.hashes == LEGACY_BLOOM_HASHES {
+		for _, salted := range []string{item, item + "salt", "prefix" + item} {
+			h := fnv.New32a()
+			h.Write([]byte(salted))
+			if !visit(uint64(h.Sum32()) % bf.size) {
+				return false
+			}
+		}
+		return true
+	}
+
+	h := hash64(item)
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	for i := range uint64(bf.hashes) {
+		if !visit((h1 + i*h2) % bf.size) {
+			return false
+		}
+	}
+	return true
 }
 
+// hash64 is FNV-1a followed by the murmur3 finalizer, which spreads FNV's
+// weak high bits.
+func hash64(item string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(item); i++ {
+		h ^= uint64(item[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// String lists the bits as '0' and '1' characters, for debugging.
 func (bf *BloomFilter) String() string {
-	result := ""
-	for _, bit := range bf.bits {
-		if bit {
-			result += "1"
+	var result strings.Builder
+	result.Grow(int(bf.size))
+	for bit := range bf.size {
+		if bf.bits[bit/64]&(1<<(bit%64)) != 0 {
+			result.WriteByte('1')
 		} else {
-			result += "0"
+			result.WriteByte('0')
 		}
 	}
-	return result
+	return result.String()
+}
+
+// Bytes encodes the filter as its size in bits and its number of hashes, both
+// unsigned varints, followed by the bits packed in little-endian 64-bit words.
+func (bf *BloomFilter) Bytes() []byte {
+	buf := binary.AppendUvarint(nil, bf.size)
+	buf = binary.AppendUvarint(buf, uint64(bf.hashes))
+	for _, word := range bf.bits {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	return buf
 }
 
-func (bf *BloomFilter) Bits() []bool {
-	return bf.bits
+// NewBloomFilterFromBytes decodes a filter encoded with Bytes.
+func NewBloomFilterFromBytes(b []byte) (*BloomFilter, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size == 0 || size > math.MaxInt32 {
+		return nil, errors.New("invalid bloom filter size")
+	}
+	b = b[n:]
+
+	hashes, n := binary.Uvarint(b)
+	if n <= 0 || hashes > MAX_BLOOM_HASHES {
+		return nil, errors.New("invalid bloom filter hash count")
+	}
+	b = b[n:]
+
+	bf := NewBloomFilter(int(size), int(hashes))
+	if len(b) != 8*len(bf.bits) {
+		return nil, fmt.Errorf("bloom filter of %d bits holds %d bytes", size, len(b))
+	}
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return bf, nil
 }
 
+// NewBloomFilterFromString decodes the text encoding of String. Tables
+// written before filters were stored in binary use it.
 func NewBloomFilterFromString(data string) *BloomFilter {
-	bf := NewEmptyBloomFilter(len(data))
+	bf := NewBloomFilter(max(len(data), 1), LEGACY_BLOOM_HASHES)
 	for i := 0; i < len(data); i++ {
 		if data[i] == '1' {
-			bf.bits[i] = true
+			bf.bits[i/64] |= 1 << (i % 64)
 		}
 	}
 	return bf
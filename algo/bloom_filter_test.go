@@ -1,6 +1,8 @@
 package algo
 
 import (
+	"fmt"
+	"hash/fnv"
 	"strings"
 	"testing"
 
@@ -98,4 +100,106 @@ func TestBloomFilterFromExampleData(t *testing.T) {
 	result2 := bf2.String()
 
 	assert.Equal(t, result, result2, "Same inputs should produce same bloom filter string")
-}
\ No newline at end of file
+}
+
+// falsePositiveRate adds keys keys to a filter sized at bitsPerKey bits per
+// key and returns the share of other keys it claims to hold.
+func falsePositiveRate(t *testing.T, keys int, bitsPerKey int) float64 {
+	bf := NewBloomFilterForKeys(keys, bitsPerKey)
+	for i := range keys {
+		bf.Add(fmt.Sprintf("key_%d", i))
+	}
+	for i := range keys {
+		assert.True(t, bf.Contains(fmt.Sprintf("key_%d", i)), "false negative")
+	}
+
+	const probes = 100000
+	falsePositives := 0
+	for i := range probes {
+		if bf.Contains(fmt.Sprintf("missing_%d", i)) {
+			falsePositives++
+		}
+	}
+	return float64(falsePositives) / probes
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	// Expected rates are (1 - e^(-k/b))^k for b bits per key and k hashes
+	testCases := []struct {
+		bitsPerKey int
+		maxRate    float64
+	}{
+		{bitsPerKey: 5, maxRate: 0.12},   // Expected 9.2%
+		{bitsPerKey: 10, maxRate: 0.012}, // Expected 0.82%
+		{bitsPerKey: 16, maxRate: 0.001}, // Expected 0.046%
+	}
+
+	for _, testCase := range testCases {
+		rate := falsePositiveRate(t, 10000, testCase.bitsPerKey)
+		t.Logf("%d bits per key: %.3f%% false positives", testCase.bitsPerKey, 100*rate)
+		assert.Less(t, rate, testCase.maxRate, "%d bits per key", testCase.bitsPerKey)
+	}
+}
+
+func TestBloomFilterForKeysSizing(t *testing.T) {
+	bf := NewBloomFilterForKeys(1000, 10)
+	assert.Equal(t, 10000, bf.Size())
+	assert.Equal(t, 7, bf.Hashes())
+
+	// Filters of empty or tiny tables still get a word of bits
+	assert.Equal(t, 64, NewBloomFilterForKeys(0, 10).Size())
+	assert.Equal(t, 1, NewBloomFilterForKeys(10, 1).Hashes())
+}
+
+func TestBloomFilterBytes(t *testing.T) {
+	bf := NewBloomFilterForKeys(100, 10)
+	for i := range 100 {
+		bf.Add(fmt.Sprintf("key_%d", i))
+	}
+
+	encoded := bf.Bytes()
+	// Size and hashes, then 1000 bits packed in 16 words
+	assert.Len(t, encoded, 2+1+16*8)
+
+	decoded, err := NewBloomFilterFromBytes(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, bf.String(), decoded.String())
+	assert.Equal(t, bf.Hashes(), decoded.Hashes())
+	for i := range 100 {
+		assert.True(t, decoded.Contains(fmt.Sprintf("key_%d", i)))
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":     {},
+		"zero size": {0, 3},
+		"truncated": encoded[:len(encoded)-1],
+		"too long":  append(encoded, 0),
+	} {
+		_, err := NewBloomFilterFromBytes(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestBloomFilterFromStringKeepsLegacyHashes(t *testing.T) {
+	bf := NewBloomFilterFromString(strings.Repeat("0", 100))
+	bf.Add("key")
+
+	// Tables written before the binary encoding set the bits of three salted
+	// FNV hashes
+	expected := []byte(strings.Repeat("0", 100))
+	for _, salted := range []string{"key", "keysalt", "prefixkey"} {
+		h := fnv.New32a()
+		h.Write([]byte(salted))
+		expected[h.Sum32()%100] = '1'
+	}
+	assert.Equal(t, string(expected), bf.String())
+
+	decoded := NewBloomFilterFromString(bf.String())
+	assert.True(t, decoded.Contains("key"))
+
+	// The scheme survives the binary encoding
+	reencoded, err := NewBloomFilterFromBytes(decoded.Bytes())
+	assert.NoError(t, err)
+	assert.True(t, reencoded.Contains("key"))
+	assert.Equal(t, LEGACY_BLOOM_HASHES, reencoded.Hashes())
+}
@@ -1,6 +1,9 @@
 package algo
 
-import "time"
+import (
+	"iter"
+	"time"
+)
 
 const (
 	RED   = true
@@ -9,6 +12,8 @@ const (
 
 type metadata struct {
 	Timestamp time.Time
+	Tombstone bool
+	SeqNumber uint64
 }
 
 type Node struct {
@@ -19,6 +24,7 @@ type Node struct {
 	Right    *Node
 	Parent   *Node
 	Metadata metadata
+	Older    *Node // Previous version of the key, kept outside of the tree
 }
 
 type RBTree struct {
@@ -40,12 +46,9 @@ func (t *RBTree) Search(key string) *Node {
 	return nil
 }
 
-func (t *RBTree) Insert(key string, value []byte) {
-	newNode := &Node{
-		Key: key, Color: RED,
-		Value:    value,
-		Metadata: metadata{Timestamp: time.Now()},
-	}
+// Insert stores value under key and returns its node. An existing key keeps
+// its node, whose value and metadata are replaced in place.
+func (t *RBTree) Insert(key string, value []byte) *Node {
 	var parent *Node
 	n := t.Root
 
@@ -53,11 +56,21 @@ func (t *RBTree) Insert(key string, value []byte) {
 		parent = n
 		if key < n.Key {
 			n = n.Left
-		} else {
+		} else if key > n.Key {
 			n = n.Right
+		} else {
+			n.Value = value
+			n.Metadata = metadata{Timestamp: time.Now()}
+			return n
 		}
 	}
 
+	newNode := &Node{
+		Key: key, Color: RED,
+		Value:    value,
+		Metadata: metadata{Timestamp: time.Now()},
+	}
+
 	newNode.Parent = parent
 	if parent == nil {
 		t.Root = newNode
@@ -70,6 +83,8 @@ func (t *RBTree) Insert(key string, value []byte) {
 	t.NodesCount++
 
 	t.fixInsert(newNode)
+
+	return newNode
 }
 
 func (t *RBTree) fixInsert(n *Node) {
@@ -117,6 +132,139 @@ func (t *RBTree) fixInsert(n *Node) {
 	t.Root.Color = BLACK
 }
 
+// Delete removes key from the tree and reports whether it was there.
+func (t *RBTree) Delete(key string) bool {
+	z := t.Search(key)
+	if z == nil {
+		return false
+	}
+
+	// y is the node taken out of its position: z itself, or its successor
+	// when z has two children. x takes the place of y and may be nil, so its
+	// parent is tracked separately
+	y := z
+	yColor := y.Color
+	var x, xParent *Node
+
+	if z.Left == nil {
+		x, xParent = z.Right, z.Parent
+		t.transplant(z, z.Right)
+	} else if z.Right == nil {
+		x, xParent = z.Left, z.Parent
+		t.transplant(z, z.Left)
+	} else {
+		y = getFirst(z.Right)
+		yColor = y.Color
+		x = y.Right
+		if y.Parent == z {
+			xParent = y
+		} else {
+			xParent = y.Parent
+			t.transplant(y, y.Right)
+			y.Right = z.Right
+			y.Right.Parent = y
+		}
+		t.transplant(z, y)
+		y.Left = z.Left
+		y.Left.Parent = y
+		y.Color = z.Color
+	}
+
+	t.NodesCount--
+
+	if yColor == BLACK {
+		t.fixDelete(x, xParent)
+	}
+
+	z.Left, z.Right, z.Parent = nil, nil, nil
+	return true
+}
+
+// transplant puts v in the position of u.
+func (t *RBTree) transplant(u, v *Node) {
+	if u.Parent == nil {
+		t.Root = v
+	} else if u == u.Parent.Left {
+		u.Parent.Left = v
+	} else {
+		u.Parent.Right = v
+	}
+	if v != nil {
+		v.Parent = u.Parent
+	}
+}
+
+func isRed(n *Node) bool {
+	return n != nil && n.Color == RED
+}
+
+// fixDelete restores the black height after a black node was removed above
+// x, which carries an extra black.
+func (t *RBTree) fixDelete(x, parent *Node) {
+	for x != t.Root && !isRed(x) {
+		if x == parent.Left {
+			sibling := parent.Right
+			if isRed(sibling) {
+				// Case 1: Sibling is red
+				sibling.Color = BLACK
+				parent.Color = RED
+				t.rotateLeft(parent)
+				sibling = parent.Right
+			}
+			if !isRed(sibling.Left) && !isRed(sibling.Right) {
+				// Case 2: Sibling black with black children
+				sibling.Color = RED
+				x, parent = parent, parent.Parent
+			} else {
+				if !isRed(sibling.Right) {
+					// Case 3: Sibling black, near child red
+					sibling.Left.Color = BLACK
+					sibling.Color = RED
+					t.rotateRight(sibling)
+					sibling = parent.Right
+				}
+				// Case 4: Sibling black, far child red
+				sibling.Color = parent.Color
+				parent.Color = BLACK
+				sibling.Right.Color = BLACK
+				t.rotateLeft(parent)
+				x = t.Root
+			}
+		} else {
+			sibling := parent.Left
+			if isRed(sibling) {
+				// Mirror Case 1
+				sibling.Color = BLACK
+				parent.Color = RED
+				t.rotateRight(parent)
+				sibling = parent.Left
+			}
+			if !isRed(sibling.Left) && !isRed(sibling.Right) {
+				// Mirror Case 2
+				sibling.Color = RED
+				x, parent = parent, parent.Parent
+			} else {
+				if !isRed(sibling.Left) {
+					// Mirror Case 3
+					sibling.Right.Color = BLACK
+					sibling.Color = RED
+					t.rotateLeft(sibling)
+					sibling = parent.Left
+				}
+				// Mirror Case 4
+				sibling.Color = parent.Color
+				parent.Color = BLACK
+				sibling.Left.Color = BLACK
+				t.rotateRight(parent)
+				x = t.Root
+			}
+		}
+	}
+	if x != nil {
+		x.Color = BLACK
+	}
+}
+
 func (t *RBTree) rotateLeft(x *Node) {
 	y := x.Right
 	x.Right = y.Left
@@ -160,24 +308,6 @@ func NewRBTree() *RBTree {
 	}
 }
 
-func (node *Node) inorderTraversal(sortedOut chan<- *Node) {
-	if node != nil {
-		node.Left.inorderTraversal(sortedOut)
-		sortedOut <- node
-		node.Right.inorderTraversal(sortedOut)
-	}
-}
-
-func (tree *RBTree) StreamInorderTraversal() <-chan *Node {
-	sortedOut := make(chan *Node)
-
-	go func() {
-		defer close(sortedOut)
-		tree.Root.inorderTraversal(sortedOut)
-	}()
-	return sortedOut
-}
-
 func getFirst(node *Node) *Node {
 	if node == nil {
 		return nil
@@ -212,3 +342,96 @@ func (tree *RBTree) Last() *Node {
 	}
 	return getLast(tree.Root)
 }
+
+// All yields the nodes in key order. The tree must not be modified while
+// iterating.
+func (tree *RBTree) All() iter.Seq[*Node] {
+	return tree.From("")
+}
+
+// From yields the nodes with keys from start on, in order.
+func (tree *RBTree) From(start string) iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		cursor := tree.Cursor()
+		for cursor.Seek(start); cursor.Valid(); cursor.Next() {
+			if !yield(cursor.Node()) {
+				return
+			}
+		}
+	}
+}
+
+// RBTreeCursor walks the nodes of a tree in either direction through their
+// parent pointers. It is invalid until positioned and once it moves past
+// either end.
+type RBTreeCursor struct {
+	tree *RBTree
+	node *Node
+}
+
+func (tree *RBTree) Cursor() *RBTreeCursor {
+	return &RBTreeCursor{tree: tree}
+}
+
+func (c *RBTreeCursor) Valid() bool {
+	return c.node != nil
+}
+
+// Node returns the node under the cursor, nil when it is invalid.
+func (c *RBTreeCursor) Node() *Node {
+	return c.node
+}
+
+// Seek moves to the first node with a key not below key.
+func (c *RBTreeCursor) Seek(key string) {
+	c.node = nil
+	n := c.tree.Root
+	for n != nil {
+		if key <= n.Key {
+			c.node = n
+			n = n.Left
+		} else {
+			n = n.Right
+		}
+	}
+}
+
+func (c *RBTreeCursor) SeekToFirst() {
+	c.node = c.tree.First()
+}
+
+func (c *RBTreeCursor) SeekToLast() {
+	c.node = c.tree.Last()
+}
+
+// Next moves to the in-order successor.
+func (c *RBTreeCursor) Next() {
+	n := c.node
+	if n == nil {
+		return
+	}
+	if n.Right != nil {
+		c.node = getFirst(n.Right)
+		return
+	}
+	for n.Parent != nil && n == n.Parent.Right {
+		n = n.Parent
+	}
+	c.node = n.Parent
+}
+
+// Prev moves to the in-order predecessor.
+func (c *RBTreeCursor) Prev() {
+	n := c.node
+	if n == nil {
+		return
+	}
+	if n.Left != nil {
+		c.node = getLast(n.Left)
+		return
+	}
+	for n.Parent != nil && n == n.Parent.Left {
+		n = n.Parent
+	}
+	c.node = n.Parent
+}
@@ -0,0 +1,140 @@
+package algo
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkRBInvariants fails t unless tree is a valid red-black search tree
+// holding exactly the keys of expected.
+func checkRBInvariants(t *testing.T, tree *RBTree, expected map[string][]byte) {
+	t.Helper()
+
+	if tree.Root != nil {
+		assert.Nil(t, tree.Root.Parent, "root has a parent")
+		assert.Equal(t, BLACK, tree.Root.Color, "root is red")
+	}
+
+	// blackHeight returns the black height of node, checking its subtree
+	var blackHeight func(node *Node) int
+	blackHeight = func(node *Node) int {
+		if node == nil {
+			return 1
+		}
+		for _, child := range []*Node{node.Left, node.Right} {
+			if child == nil {
+				continue
+			}
+			assert.Same(t, node, child.Parent, "broken parent link of %q", child.Key)
+			if isRed(node) {
+				assert.False(t, isRed(child), "red node %q has a red child", node.Key)
+			}
+		}
+		left, right := blackHeight(node.Left), blackHeight(node.Right)
+		assert.Equal(t, left, right, "unbalanced black height at %q", node.Key)
+		if node.Color == BLACK {
+			return left + 1
+		}
+		return left
+	}
+	blackHeight(tree.Root)
+
+	var keys []string
+	for node := range tree.All() {
+		keys = append(keys, node.Key)
+		assert.Equal(t, expected[node.Key], node.Value, "value of %q", node.Key)
+	}
+	assert.True(t, sort.StringsAreSorted(keys), "keys out of order")
+
+	// Walking back through the parent pointers visits the same keys
+	var backward []string
+	cursor := tree.Cursor()
+	for cursor.SeekToLast(); cursor.Valid(); cursor.Prev() {
+		backward = append([]string{cursor.Node().Key}, backward...)
+	}
+	assert.Equal(t, keys, backward)
+	assert.Len(t, keys, len(expected))
+	assert.Equal(t, len(expected), tree.NodesCount)
+}
+
+func TestRBTreeInsertReplaces(t *testing.T) {
+	tree := NewRBTree()
+
+	first := tree.Insert("key", []byte("old"))
+	first.Metadata.Tombstone = true
+	second := tree.Insert("key", []byte("new"))
+
+	assert.Same(t, first, second)
+	assert.Equal(t, 1, tree.NodesCount)
+	assert.Equal(t, []byte("new"), tree.Search("key").Value)
+	assert.False(t, tree.Search("key").Metadata.Tombstone)
+}
+
+func TestRBTreeDelete(t *testing.T) {
+	tree := NewRBTree()
+	for _, key := range []string{"d", "b", "f", "a", "c", "e", "g"} {
+		tree.Insert(key, []byte(key))
+	}
+
+	assert.True(t, tree.Delete("d"))
+	assert.False(t, tree.Delete("d"))
+	assert.False(t, tree.Delete("missing"))
+	assert.Nil(t, tree.Search("d"))
+	checkRBInvariants(t, tree, map[string][]byte{
+		"a": []byte("a"), "b": []byte("b"), "c": []byte("c"),
+		"e": []byte("e"), "f": []byte("f"), "g": []byte("g"),
+	})
+
+	for _, key := range []string{"a", "b", "c", "e", "f", "g"} {
+		assert.True(t, tree.Delete(key))
+	}
+	assert.Nil(t, tree.Root)
+	assert.Equal(t, 0, tree.NodesCount)
+	assert.Nil(t, tree.First())
+}
+
+func TestRBTreeRandomOperations(t *testing.T) {
+	for seed := range uint64(20) {
+		t.Run(fmt.Sprintf("seed_%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(seed, seed))
+			tree := NewRBTree()
+			expected := make(map[string][]byte)
+
+			for i := range 2000 {
+				key := fmt.Sprintf("key_%03d", rng.IntN(300))
+				if rng.IntN(3) == 0 {
+					_, ok := expected[key]
+					assert.Equal(t, ok, tree.Delete(key), "delete %q", key)
+					delete(expected, key)
+				} else {
+					value := []byte(fmt.Sprint(i))
+					tree.Insert(key, value)
+					expected[key] = value
+				}
+
+				if i%100 == 0 {
+					checkRBInvariants(t, tree, expected)
+				}
+			}
+			checkRBInvariants(t, tree, expected)
+
+			// Drain the tree in random order
+			keys := make([]string, 0, len(expected))
+			for key := range expected {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+			for _, key := range keys {
+				assert.True(t, tree.Delete(key))
+				delete(expected, key)
+			}
+			checkRBInvariants(t, tree, expected)
+			assert.Nil(t, tree.Root)
+		})
+	}
+}
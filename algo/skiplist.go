@@ -0,0 +1,237 @@
+package algo
+
+import (
+	"iter"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+const SKIPLIST_MAX_HEIGHT = 12
+
+// Every level holds one in SKIPLIST_BRANCHING elements of the level below
+const SKIPLIST_BRANCHING = 4
+
+// SkipList is a sorted map from keys to Nodes that is safe for concurrent use
+// without locks: inserts link elements in with compare-and-swap and readers
+// never wait. Keys are never removed. The Node of a key is replaced as a
+// whole, so a Node must not be modified once it is stored.
+type SkipList struct {
+	head   *skipListElement
+	length atomic.Int64
+}
+
+type skipListElement struct {
+	key  string
+	node atomic.Pointer[Node]
+	next []atomic.Pointer[skipListElement]
+}
+
+func NewSkipList() *SkipList {
+	return &SkipList{
+		head: &skipListElement{next: make([]atomic.Pointer[skipListElement], SKIPLIST_MAX_HEIGHT)},
+	}
+}
+
+// Len returns the number of keys in the list.
+func (l *SkipList) Len() int {
+	return int(l.length.Load())
+}
+
+func randomHeight() int {
+	height := 1
+	for height < SKIPLIST_MAX_HEIGHT && rand.IntN(SKIPLIST_BRANCHING) == 0 {
+		height++
+	}
+	return height
+}
+
+// findSplice fills preds and succs with the elements around key on every
+// level. It returns the element of key if the list holds it.
+func (l *SkipList) findSplice(key string, preds, succs *[SKIPLIST_MAX_HEIGHT]*skipListElement) *skipListElement {
+	var found *skipListElement
+	pred := l.head
+	for level := SKIPLIST_MAX_HEIGHT - 1; level >= 0; level-- {
+		pred, succs[level] = findSpliceForLevel(key, level, pred)
+		preds[level] = pred
+		if succs[level] != nil && succs[level].key == key {
+			found = succs[level]
+		}
+	}
+	return found
+}
+
+// findSpliceForLevel walks level from pred, which must be before key, to the
+// last element before key and returns it with its successor.
+func findSpliceForLevel(key string, level int, pred *skipListElement) (*skipListElement, *skipListElement) {
+	next := pred.next[level].Load()
+	for next != nil && next.key < key {
+		pred = next
+		next = pred.next[level].Load()
+	}
+	return pred, next
+}
+
+// Upsert stores update(current) as the Node of key, where current is the
+// Node stored so far or nil, and returns current. update may be called more
+// than once when other writers race on the same key, so it must not have
+// side effects.
+func (l *SkipList) Upsert(key string, update func(current *Node) *Node) *Node {
+	var preds, succs [SKIPLIST_MAX_HEIGHT]*skipListElement
+
+	for {
+		if element := l.findSplice(key, &preds, &succs); element != nil {
+			for {
+				current := element.node.Load()
+				if element.node.CompareAndSwap(current, update(current)) {
+					return current
+				}
+			}
+		}
+
+		element := &skipListElement{
+			key:  key,
+			next: make([]atomic.Pointer[skipListElement], randomHeight()),
+		}
+		element.node.Store(update(nil))
+
+		// Linking level 0 makes the key visible. If another element was linked
+		// in the meantime, possibly for the same key, start over
+		element.next[0].Store(succs[0])
+		if !preds[0].next[0].CompareAndSwap(succs[0], element) {
+			continue
+		}
+		l.length.Add(1)
+
+		// The upper levels only speed up searches, so they may lag behind
+		for level := 1; level < len(element.next); level++ {
+			for {
+				element.next[level].Store(succs[level])
+				if preds[level].next[level].CompareAndSwap(succs[level], element) {
+					break
+				}
+				preds[level], succs[level] = findSpliceForLevel(key, level, preds[level])
+			}
+		}
+
+		return nil
+	}
+}
+
+func (l *SkipList) Search(key string) *Node {
+	var preds, succs [SKIPLIST_MAX_HEIGHT]*skipListElement
+	if element := l.findSplice(key, &preds, &succs); element != nil {
+		return element.node.Load()
+	}
+	return nil
+}
+
+// seek returns the first element with a key not below start.
+func (l *SkipList) seek(start string) *skipListElement {
+	pred := l.head
+	var next *skipListElement
+	for level := SKIPLIST_MAX_HEIGHT - 1; level >= 0; level-- {
+		pred, next = findSpliceForLevel(start, level, pred)
+	}
+	return next
+}
+
+func (l *SkipList) First() *Node {
+	if element := l.head.next[0].Load(); element != nil {
+		return element.node.Load()
+	}
+	return nil
+}
+
+func (l *SkipList) Last() *Node {
+	if element := l.last(); element != nil {
+		return element.node.Load()
+	}
+	return nil
+}
+
+func (l *SkipList) last() *skipListElement {
+	element := l.head
+	for level := SKIPLIST_MAX_HEIGHT - 1; level >= 0; level-- {
+		for next := element.next[level].Load(); next != nil; next = element.next[level].Load() {
+			element = next
+		}
+	}
+	if element == l.head {
+		return nil
+	}
+	return element
+}
+
+// All yields the Nodes of all keys in order. Keys inserted while iterating
+// may or may not be yielded.
+func (l *SkipList) All() iter.Seq[*Node] {
+	return l.From("")
+}
+
+// From yields the Nodes of the keys from start on, in order.
+func (l *SkipList) From(start string) iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		for element := l.seek(start); element != nil; element = element.next[0].Load() {
+			if !yield(element.node.Load()) {
+				return
+			}
+		}
+	}
+}
+
+// SkipListCursor walks the keys of a list in either direction. Elements only
+// link forward, so Prev searches the list again. It is invalid until
+// positioned and once it moves past either end.
+type SkipListCursor struct {
+	list    *SkipList
+	element *skipListElement
+}
+
+func (l *SkipList) Cursor() *SkipListCursor {
+	return &SkipListCursor{list: l}
+}
+
+func (c *SkipListCursor) Valid() bool {
+	return c.element != nil
+}
+
+// Node returns the Node of the key under the cursor, nil when it is invalid.
+func (c *SkipListCursor) Node() *Node {
+	if c.element == nil {
+		return nil
+	}
+	return c.element.node.Load()
+}
+
+// Seek moves to the first key not below key.
+func (c *SkipListCursor) Seek(key string) {
+	c.element = c.list.seek(key)
+}
+
+func (c *SkipListCursor) SeekToFirst() {
+	c.element = c.list.head.next[0].Load()
+}
+
+func (c *SkipListCursor) SeekToLast() {
+	c.element = c.list.last()
+}
+
+func (c *SkipListCursor) Next() {
+	if c.element != nil {
+		c.element = c.element.next[0].Load()
+	}
+}
+
+func (c *SkipListCursor) Prev() {
+	if c.element == nil {
+		return
+	}
+	pred := c.list.head
+	for level := SKIPLIST_MAX_HEIGHT - 1; level >= 0; level-- {
+		pred, _ = findSpliceForLevel(c.element.key, level, pred)
+	}
+	if pred == c.list.head {
+		pred = nil
+	}
+	c.element = pred
+}
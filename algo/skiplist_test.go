@@ -0,0 +1,75 @@
+package algo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func put(l *SkipList, key, value string) *Node {
+	return l.Upsert(key, func(*Node) *Node {
+		return &Node{Key: key, Value: []byte(value)}
+	})
+}
+
+func TestSkipListUpsert(t *testing.T) {
+	l := NewSkipList()
+	assert.Nil(t, l.First())
+	assert.Nil(t, l.Last())
+
+	assert.Nil(t, put(l, "b", "1"))
+	assert.Nil(t, put(l, "c", "1"))
+	assert.Nil(t, put(l, "a", "1"))
+	previous := put(l, "b", "2")
+	assert.Equal(t, []byte("1"), previous.Value)
+
+	assert.Equal(t, 3, l.Len())
+	assert.Equal(t, []byte("2"), l.Search("b").Value)
+	assert.Nil(t, l.Search("d"))
+	assert.Equal(t, "a", l.First().Key)
+	assert.Equal(t, "c", l.Last().Key)
+
+	var keys []string
+	for node := range l.From("aa") {
+		keys = append(keys, node.Key)
+	}
+	assert.Equal(t, []string{"b", "c"}, keys)
+}
+
+func TestSkipListConcurrentUpsert(t *testing.T) {
+	l := NewSkipList()
+
+	const writers = 8
+	const keys = 500
+
+	// Every writer increments every key, so updates of a key race too
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				key := fmt.Sprintf("key%04d", i)
+				l.Upsert(key, func(current *Node) *Node {
+					count := 0
+					if current != nil {
+						count = len(current.Value)
+					}
+					return &Node{Key: key, Value: make([]byte, count+1)}
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, keys, l.Len())
+	i := 0
+	for node := range l.All() {
+		assert.Equal(t, fmt.Sprintf("key%04d", i), node.Key)
+		assert.Len(t, node.Value, writers)
+		i++
+	}
+	assert.Equal(t, keys, i)
+}
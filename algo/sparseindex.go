@@ -1,7 +1,11 @@
 package algo
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -26,6 +30,16 @@ func (si *SparseIndex) Get(key SparseIndexKey) (SparseIndexOffset, bool) {
 	return offset, exists
 }
 
+// SortedKeys returns the indexed keys in ascending order.
+func (si *SparseIndex) SortedKeys() []SparseIndexKey {
+	keys := make([]SparseIndexKey, 0, len(si.Index))
+	for key := range si.Index {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
 func NewSparseIndex() *SparseIndex {
 	return &SparseIndex{
 		Index:             make(map[SparseIndexKey]SparseIndexOffset),
@@ -33,14 +47,63 @@ func NewSparseIndex() *SparseIndex {
 	}
 }
 
+// String lists the entries as key:offset pairs in key order. Keys holding
+// ':' or ',' do not survive NewSparseIndexFromString, so SSTables store the
+// index with Bytes instead.
 func (si *SparseIndex) String() string {
 	var result []string
-	for key, offset := range si.Index {
-		result = append(result, fmt.Sprintf("%s:%d", key, offset))
+	for _, key := range si.SortedKeys() {
+		result = append(result, fmt.Sprintf("%s:%d", key, si.Index[key]))
 	}
 	return strings.Join(result, ",")
 }
 
+// Bytes encodes the index in key order as an entry count followed by the
+// entries, each a length-prefixed key and an offset. All integers are
+// unsigned varints.
+func (si *SparseIndex) Bytes() []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(si.Index)))
+	for _, key := range si.SortedKeys() {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(si.Index[key]))
+	}
+	return buf
+}
+
+// NewSparseIndexFromBytes decodes an index encoded with Bytes.
+func NewSparseIndexFromBytes(b []byte) (*SparseIndex, error) {
+	si := NewSparseIndex()
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("invalid sparse index entry count")
+	}
+	b = b[n:]
+
+	for i := range count {
+		keySize, n := binary.Uvarint(b)
+		if n <= 0 || keySize > uint64(len(b)-n) {
+			return nil, fmt.Errorf("invalid sparse index key size in entry %d", i)
+		}
+		key := SparseIndexKey(b[n : n+int(keySize)])
+		b = b[n+int(keySize):]
+
+		offset, n := binary.Uvarint(b)
+		if n <= 0 || offset > math.MaxInt64 {
+			return nil, fmt.Errorf("invalid sparse index offset in entry %d", i)
+		}
+		b = b[n:]
+
+		si.Index[key] = SparseIndexOffset(offset)
+	}
+
+	if len(b) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after sparse index", len(b))
+	}
+	return si, nil
+}
+
 func NewSparseIndexFromString(s string) *SparseIndex {
 	si := NewSparseIndex()
 	if s == "" {
@@ -49,12 +112,13 @@ func NewSparseIndexFromString(s string) *SparseIndex {
 	entries := strings.SplitSeq(s, ",")
 
 	for entry := range entries {
-		parts := strings.Split(entry, ":")
-		if len(parts) != 2 {
+		// Offsets hold no ':', so the last one ends the key
+		separator := strings.LastIndex(entry, ":")
+		if separator < 0 {
 			continue
 		}
-		key := SparseIndexKey(parts[0])
-		offsetInt, err := strconv.ParseInt(parts[1], 10, 64)
+		key := SparseIndexKey(entry[:separator])
+		offsetInt, err := strconv.ParseInt(entry[separator+1:], 10, 64)
 
 		if err != nil {
 			continue
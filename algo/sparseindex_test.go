@@ -40,3 +40,54 @@ func TestSparseIndexUpdate(t *testing.T) {
 	// Check only one entry exists
 	assert.Len(t, si.Index, 1, "Should contain exactly one entry after updates")
 }
+
+func TestSparseIndexBytes(t *testing.T) {
+	si := NewSparseIndex()
+	si.Update("tenant:user", 300)
+	si.Update("https://example.com/a?b=1,2", 0)
+	si.Update("", 7)
+	si.Update("key_🔥", 1<<40)
+
+	decoded, err := NewSparseIndexFromBytes(si.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, si.Index, decoded.Index)
+
+	// Entries are encoded in key order, whatever the insertion order
+	reordered := NewSparseIndex()
+	for _, key := range []SparseIndexKey{"key_🔥", "", "tenant:user", "https://example.com/a?b=1,2"} {
+		reordered.Update(key, si.Index[key])
+	}
+	assert.Equal(t, si.Bytes(), reordered.Bytes())
+
+	empty, err := NewSparseIndexFromBytes(NewSparseIndex().Bytes())
+	assert.NoError(t, err)
+	assert.Empty(t, empty.Index)
+}
+
+func TestSparseIndexBytesInvalid(t *testing.T) {
+	si := NewSparseIndex()
+	si.Update("key", 42)
+	encoded := si.Bytes()
+
+	testCases := map[string][]byte{
+		"empty":          {},
+		"truncated key":  encoded[:3],
+		"missing offset": encoded[:len(encoded)-1],
+		"trailing bytes": append(encoded, 0),
+		"key too long":   {1, 200, 'k'},
+	}
+
+	for name, data := range testCases {
+		_, err := NewSparseIndexFromBytes(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSparseIndexFromStringKeepsColons(t *testing.T) {
+	si := NewSparseIndex()
+	si.Update("tenant:user", 10)
+	si.Update("a", 0)
+
+	assert.Equal(t, "a:0,tenant:user:10", si.String())
+	assert.Equal(t, si.Index, NewSparseIndexFromString(si.String()).Index)
+}
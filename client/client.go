@@ -7,6 +7,17 @@ import (
 )
 
 type Request struct {
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	End       string    `json:"end,omitempty"`
+	Limit     int       `json:"limit,omitempty"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Ops       []BatchOp `json:"ops,omitempty"`
+}
+
+// BatchOp is a single SET or DEL of a BATCH request.
+type BatchOp struct {
 	Operation string `json:"operation"`
 	Key       string `json:"key"`
 	Value     string `json:"value,omitempty"`
@@ -93,6 +104,55 @@ func (c *DBClient) Write(key string, value []byte) error {
 	return nil
 }
 
+func (c *DBClient) Delete(key string) error {
+	_, err := c.send(Request{Operation: "DEL", Key: key})
+	return err
+}
+
+// Begin starts a transaction on the connection. Reads and writes sent until
+// Commit or Rollback belong to it.
+func (c *DBClient) Begin() error {
+	_, err := c.send(Request{Operation: "BEGIN"})
+	return err
+}
+
+// Commit fails if a key read in the transaction was changed by someone else.
+func (c *DBClient) Commit() error {
+	_, err := c.send(Request{Operation: "COMMIT"})
+	return err
+}
+
+func (c *DBClient) Rollback() error {
+	_, err := c.send(Request{Operation: "ROLLBACK"})
+	return err
+}
+
+// send returns the data of a successful response and the server's error
+// otherwise.
+func (c *DBClient) send(req Request) (string, error) {
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	if !resp.Success {
+		return "", fmt.Errorf("%s", resp.Error)
+	}
+
+	return resp.Data, nil
+}
+
+// Apply writes every SET and DEL of ops atomically.
+func (c *DBClient) Apply(ops []BatchOp) error {
+	_, err := c.send(Request{Operation: "BATCH", Ops: ops})
+	return err
+}
+
+// Stats lists the storage statistics as name=value lines.
+func (c *DBClient) Stats() (string, error) {
+	return c.send(Request{Operation: "STATS"})
+}
+
 func (c *DBClient) List() (string, error) {
 	req := Request{
 		Operation: "LIST",
@@ -110,6 +170,30 @@ func (c *DBClient) List() (string, error) {
 	return resp.Data, nil
 }
 
+// Scan lists the entries with keys in [start, end), at most limit of them.
+// An empty end leaves the range open and a limit of 0 means no limit.
+func (c *DBClient) Scan(start, end string, limit int) (string, error) {
+	req := Request{
+		Operation: "SCAN",
+		Key:       start,
+		End:       end,
+		Limit:     limit,
+	}
+
+	return c.send(req)
+}
+
+// ScanPrefix lists the entries with keys starting with prefix.
+func (c *DBClient) ScanPrefix(prefix string, limit int) (string, error) {
+	req := Request{
+		Operation: "SCAN",
+		Prefix:    prefix,
+		Limit:     limit,
+	}
+
+	return c.send(req)
+}
+
 func (c *DBClient) sendRequest(req Request) (*Response, error) {
 	if c.conn == nil {
 		if err := c.Connect(); err != nil {
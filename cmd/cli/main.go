@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/charmbracelet/bubbles/textinput"
@@ -42,7 +43,7 @@ type model struct {
 
 func initialModel() model {
 	ti := textinput.New()
-	ti.Placeholder = "Enter command (read <key>, write <key> <value>, list, help, quit)"
+	ti.Placeholder = "Enter command (read <key>, write <key> <value>, delete <key>, list, scan <start> [end] [limit], prefix <prefix>, stats, help, quit)"
 	ti.Focus()
 	ti.CharLimit = 156
 	ti.Width = 60
@@ -113,7 +114,11 @@ func (m model) processCommand(input string) model {
 			"Available commands:",
 			"  read <key>           - Read value for a key",
 			"  write <key> <value>  - Write value to a key",
+			"  delete <key>         - Delete a key",
 			"  list                 - List all key-value pairs",
+			"  scan <start> [end] [limit] - List pairs with keys in [start, end)",
+			"  prefix <prefix>      - List pairs with keys starting with prefix",
+			"  stats                - Show storage statistics",
 			"  help                 - Show this help message",
 			"  quit                 - Exit the CLI",
 		}
@@ -148,24 +153,73 @@ func (m model) processCommand(input string) model {
 			}
 		}
 
+	case "delete", "d":
+		if len(parts) != 2 {
+			m.output = append(m.output, errorStyle.Render("Usage: delete <key>"))
+		} else {
+			key := parts[1]
+			err := m.client.Delete(key)
+			if err != nil {
+				m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Error deleting '%s': %v", key, err)))
+			} else {
+				m.output = append(m.output, successStyle.Render(fmt.Sprintf("✓ Deleted: %s", key)))
+			}
+		}
+
 	case "list", "l":
 		data, err := m.client.List()
 		if err != nil {
 			m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Error listing entries: %v", err)))
 		} else {
-			if data == "" {
-				m.output = append(m.output, infoStyle.Render("No entries found"))
+			m.appendEntries("All entries:", data)
+		}
+
+	case "scan", "s":
+		if len(parts) < 2 || len(parts) > 4 {
+			m.output = append(m.output, errorStyle.Render("Usage: scan <start> [end] [limit]"))
+			break
+		}
+
+		start, end, limit := parts[1], "", 0
+		if len(parts) > 2 {
+			end = parts[2]
+		}
+		if len(parts) > 3 {
+			n, err := strconv.Atoi(parts[3])
+			if err != nil {
+				m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Invalid limit: %s", parts[3])))
+				break
+			}
+			limit = n
+		}
+
+		data, err := m.client.Scan(start, end, limit)
+		if err != nil {
+			m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Error scanning entries: %v", err)))
+		} else {
+			m.appendEntries("Entries in range:", data)
+		}
+
+	case "prefix", "p":
+		if len(parts) != 2 {
+			m.output = append(m.output, errorStyle.Render("Usage: prefix <prefix>"))
+		} else {
+			data, err := m.client.ScanPrefix(parts[1], 0)
+			if err != nil {
+				m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Error scanning entries: %v", err)))
 			} else {
-				m.output = append(m.output, successStyle.Render("All entries:"))
-				entries := strings.Split(data, "\n")
-				for _, entry := range entries {
-					if entry != "" {
-						m.output = append(m.output, fmt.Sprintf("  %s", entry))
-					}
-				}
+				m.appendEntries(fmt.Sprintf("Entries starting with '%s':", parts[1]), data)
 			}
 		}
 
+	case "stats":
+		data, err := m.client.Stats()
+		if err != nil {
+			m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Error reading stats: %v", err)))
+		} else {
+			m.appendEntries("Storage statistics:", data)
+		}
+
 	default:
 		m.output = append(m.output, errorStyle.Render(fmt.Sprintf("Unknown command: %s. Type 'help' for available commands.", command)))
 	}
@@ -178,6 +232,21 @@ func (m model) processCommand(input string) model {
 	return m
 }
 
+// appendEntries renders the newline separated key=value pairs of data.
+func (m *model) appendEntries(title string, data string) {
+	if data == "" {
+		m.output = append(m.output, infoStyle.Render("No entries found"))
+		return
+	}
+
+	m.output = append(m.output, successStyle.Render(title))
+	for _, entry := range strings.Split(data, "\n") {
+		if entry != "" {
+			m.output = append(m.output, fmt.Sprintf("  %s", entry))
+		}
+	}
+}
+
 func (m model) View() string {
 	var b strings.Builder
 
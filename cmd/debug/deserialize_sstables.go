@@ -234,9 +234,11 @@ func formatDeserialized(d *core.Deserialized) string {
 	var sb strings.Builder
 
 	sb.WriteString("=== SSTable Contents ===\n\n")
+	sb.WriteString(fmt.Sprintf("Format version: %d\n\n", d.Version))
 
 	sb.WriteString("BLOOM FILTER:\n")
-	sb.WriteString(fmt.Sprintf("Size: %d bits\n", len(d.BloomFilter.Bits())))
+	sb.WriteString(fmt.Sprintf("Size: %d bits\n", d.BloomFilter.Size()))
+	sb.WriteString(fmt.Sprintf("Hashes: %d\n", d.BloomFilter.Hashes()))
 	sb.WriteString(fmt.Sprintf("Data: %s\n\n", d.BloomFilter.String()))
 
 	sb.WriteString("SPARSE INDEX:\n")
@@ -251,6 +253,7 @@ func formatDeserialized(d *core.Deserialized) string {
 		sb.WriteString(fmt.Sprintf("  Value: %s\n", string(record.Value)))
 		sb.WriteString(fmt.Sprintf("  Timestamp: %d\n", int64(record.Timestamp)))
 		sb.WriteString(fmt.Sprintf("  Tombstone: %t\n", bool(record.Tombstone)))
+		sb.WriteString(fmt.Sprintf("  SeqNumber: %d\n", record.SeqNumber))
 		sb.WriteString("\n")
 	}
 
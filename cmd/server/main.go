@@ -2,23 +2,62 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/ogioldat/ttrunksdb/core"
 	"github.com/ogioldat/ttrunksdb/internal"
 )
 
+var (
+	walSyncMode     = flag.String("wal-sync", core.WALSyncInterval.String(), "WAL fsync policy: always, group, interval, none")
+	walSyncInterval = flag.Duration("wal-sync-interval", core.DEFAULT_WAL_SYNC_INTERVAL, "fsync period for the interval WAL sync policy")
+	walSyncBytes    = flag.Int("wal-sync-bytes", core.DEFAULT_WAL_SYNC_BYTES, "pending bytes that trigger an fsync for the group WAL sync policy")
+	compaction      = flag.String("compaction", "leveled", "compaction strategy: leveled, size-tiered")
+	memTableType    = flag.String("memtable", core.MemTableRBTree.String(), "memtable implementation: rbtree, skiplist")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time in-flight requests get to finish on shutdown")
+)
+
 type Server struct {
 	db   core.DB
 	addr string
+
+	mu           sync.Mutex
+	listener     net.Listener
+	conns        map[net.Conn]struct{}
+	shuttingDown bool
+	handlers     sync.WaitGroup
+}
+
+// session is the state of a single connection.
+type session struct {
+	txn *core.Txn // Open transaction, if any
 }
 
 type Request struct {
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	End       string    `json:"end,omitempty"`
+	Limit     int       `json:"limit,omitempty"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Ops       []BatchOp `json:"ops,omitempty"`
+}
+
+// BatchOp is a single SET or DEL of a BATCH request.
+type BatchOp struct {
 	Operation string `json:"operation"`
 	Key       string `json:"key"`
 	Value     string `json:"value,omitempty"`
@@ -32,19 +71,34 @@ type Response struct {
 
 func NewServer(addr string, db core.DB) *Server {
 	return &Server{
-		db:   db,
-		addr: addr,
+		db:    db,
+		addr:  addr,
+		conns: make(map[net.Conn]struct{}),
 	}
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	defer s.handlers.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
 
 	scanner := bufio.NewScanner(conn)
 	encoder := json.NewEncoder(conn)
 
 	internal.Logger.Info("Client connected", "addr", conn.RemoteAddr())
 
+	sess := &session{}
+	defer func() {
+		// A transaction left open by the client is abandoned
+		if sess.txn != nil {
+			sess.txn.Rollback()
+		}
+	}()
+
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
@@ -58,28 +112,63 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		resp := s.processRequest(req)
+		resp := s.processRequest(sess, req)
 		if err := encoder.Encode(resp); err != nil {
 			log.Printf("Error encoding response: %v", err)
 			break
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
 		internal.Logger.Info("Connection error", "err", err)
 	}
 
 	internal.Logger.Info("Client disconnected", "addr", conn.RemoteAddr())
 }
 
-func (s *Server) processRequest(req Request) Response {
+func (s *Server) processRequest(sess *session, req Request) Response {
 	switch strings.ToUpper(req.Operation) {
+	case "BEGIN":
+		if sess.txn != nil {
+			return Response{Success: false, Error: "Transaction already in progress"}
+		}
+
+		sess.txn = s.db.Begin()
+		return Response{Success: true}
+
+	case "COMMIT":
+		if sess.txn == nil {
+			return Response{Success: false, Error: "No transaction in progress"}
+		}
+
+		err := sess.txn.Commit()
+		sess.txn = nil
+		if err != nil {
+			return Response{Success: false, Error: err.Error()}
+		}
+
+		return Response{Success: true}
+
+	case "ROLLBACK":
+		if sess.txn == nil {
+			return Response{Success: false, Error: "No transaction in progress"}
+		}
+
+		sess.txn.Rollback()
+		sess.txn = nil
+		return Response{Success: true}
+
 	case "GET":
 		if req.Key == "" {
 			return Response{Success: false, Error: "Key required for GET operation"}
 		}
 
-		value, err := s.db.Read(req.Key)
+		read := s.db.Read
+		if sess.txn != nil {
+			read = sess.txn.Get
+		}
+
+		value, err := read(req.Key)
 		if err != nil {
 			return Response{Success: false, Error: err.Error()}
 		}
@@ -91,7 +180,29 @@ func (s *Server) processRequest(req Request) Response {
 			return Response{Success: false, Error: "Key required for SET operation"}
 		}
 
-		err := s.db.Write(req.Key, []byte(req.Value))
+		write := s.db.Write
+		if sess.txn != nil {
+			write = sess.txn.Put
+		}
+
+		err := write(req.Key, []byte(req.Value))
+		if err != nil {
+			return Response{Success: false, Error: err.Error()}
+		}
+
+		return Response{Success: true}
+
+	case "DEL":
+		if req.Key == "" {
+			return Response{Success: false, Error: "Key required for DEL operation"}
+		}
+
+		del := s.db.Delete
+		if sess.txn != nil {
+			del = sess.txn.Delete
+		}
+
+		err := del(req.Key)
 		if err != nil {
 			return Response{Success: false, Error: err.Error()}
 		}
@@ -99,6 +210,10 @@ func (s *Server) processRequest(req Request) Response {
 		return Response{Success: true}
 
 	case "LIST":
+		if sess.txn != nil {
+			return Response{Success: false, Error: "LIST is not supported inside a transaction"}
+		}
+
 		var keys []string
 
 		for key, value := range s.db.Iter {
@@ -108,32 +223,161 @@ func (s *Server) processRequest(req Request) Response {
 		data := strings.Join(keys, "\n")
 		return Response{Success: true, Data: data}
 
+	case "SCAN":
+		if sess.txn != nil {
+			return Response{Success: false, Error: "SCAN is not supported inside a transaction"}
+		}
+
+		var results []core.KeyValue
+		var err error
+
+		// The key is the start of the range, unless a prefix is given
+		if req.Prefix != "" {
+			results, err = s.db.Scan(req.Prefix, core.PrefixEnd(req.Prefix), req.Limit)
+		} else {
+			results, err = s.db.Scan(req.Key, req.End, req.Limit)
+		}
+		if err != nil {
+			return Response{Success: false, Error: err.Error()}
+		}
+
+		var entries []string
+		for _, result := range results {
+			entries = append(entries, fmt.Sprintf("%s=%s", result.Key, string(result.Value)))
+		}
+
+		return Response{Success: true, Data: strings.Join(entries, "\n")}
+
+	case "STATS":
+		stats := s.db.Stats()
+		lines := []string{
+			fmt.Sprintf("seq_number=%d", stats.SeqNumber),
+			fmt.Sprintf("memtable_entries=%d", stats.MemTableEntries),
+			fmt.Sprintf("memtable_bytes=%d", stats.MemTableBytes),
+			fmt.Sprintf("immutable_memtables=%d", stats.ImmutableMemTables),
+			fmt.Sprintf("immutable_memtable_bytes=%d", stats.ImmutableMemTableBytes),
+			fmt.Sprintf("snapshots=%d", stats.Snapshots),
+		}
+		for level, levelStats := range stats.Levels {
+			lines = append(lines,
+				fmt.Sprintf("level_%d_tables=%d", level, levelStats.Tables),
+				fmt.Sprintf("level_%d_bytes=%d", level, levelStats.Bytes),
+			)
+		}
+
+		return Response{Success: true, Data: strings.Join(lines, "\n")}
+
+	case "BATCH":
+		if sess.txn != nil {
+			return Response{Success: false, Error: "BATCH is not supported inside a transaction"}
+		}
+
+		batch := core.NewWriteBatch()
+		for _, op := range req.Ops {
+			if op.Key == "" {
+				return Response{Success: false, Error: "Key required for every BATCH operation"}
+			}
+			switch strings.ToUpper(op.Operation) {
+			case "SET":
+				batch.Put(op.Key, []byte(op.Value))
+			case "DEL":
+				batch.Delete(op.Key)
+			default:
+				return Response{Success: false, Error: "Unsupported BATCH operation: " + op.Operation}
+			}
+		}
+
+		if err := s.db.Apply(batch); err != nil {
+			return Response{Success: false, Error: err.Error()}
+		}
+
+		return Response{Success: true}
+
 	default:
 		return Response{Success: false, Error: "Unsupported operation: " + req.Operation}
 	}
 }
 
+// Start serves connections until Shutdown is called.
 func (s *Server) Start() error {
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %v", s.addr, err)
 	}
-	defer listener.Close()
+
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mu.Unlock()
 
 	internal.Logger.Info("Database server listening", "addr", s.addr)
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			internal.Logger.Info("Error accepting connection", "err", err)
 			continue
 		}
 
+		s.mu.Lock()
+		if s.shuttingDown {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+
 		go s.handleConnection(conn)
 	}
 }
 
+// Shutdown stops accepting connections and waits for the requests in flight
+// to be answered. Idle connections are closed right away. Connections still
+// busy when ctx expires are closed forcibly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// Unblocks the reads of idle connections; a request being processed is
+	// still answered before its handler sees the deadline
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-drained
+		return ctx.Err()
+	}
+}
+
 func main() {
+	flag.Parse()
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
@@ -141,14 +385,73 @@ func main() {
 
 	internal.InitLogger()
 
+	syncMode, err := core.ParseWALSyncMode(*walSyncMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	memTable, err := core.ParseMemTableType(*memTableType)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []core.Option{
+		core.WithMemTableType(memTable),
+		core.WithWALSyncMode(syncMode),
+		core.WithWALSyncInterval(*walSyncInterval),
+		core.WithWALSyncBytes(*walSyncBytes),
+	}
+
+	switch *compaction {
+	case "leveled":
+	case "size-tiered":
+		opts = append(opts, core.WithCompactionStrategy(core.NewSizeTieredCompactionStrategy()))
+	default:
+		log.Fatalf("unknown compaction strategy: %s", *compaction)
+	}
+
 	// Initialize the database
-	db := core.NewLSMTStorage()
+	db := core.NewLSMTStorage(opts...)
+
+	switch syncMode {
+	case core.WALSyncGroup:
+		internal.Logger.Info("WAL sync mode", "mode", syncMode, "bytes", *walSyncBytes)
+	case core.WALSyncInterval:
+		internal.Logger.Info("WAL sync mode", "mode", syncMode, "interval", *walSyncInterval)
+	default:
+		internal.Logger.Info("WAL sync mode", "mode", syncMode)
+	}
+
+	internal.Logger.Info("Compaction strategy", "strategy", *compaction)
 
 	// Create and start the server
 	server := NewServer(":8080", db)
 
-	internal.Logger.Info("Starting database server...")
-	if err := server.Start(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		internal.Logger.Info("Starting database server...")
+		served <- server.Start()
+	}()
+
+	select {
+	case err := <-served:
 		internal.Logger.Info("Server failed", "err", err)
+	case <-ctx.Done():
+		internal.Logger.Info("Shutting down", "timeout", *shutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		internal.Logger.Warn("Connections closed before their requests finished", "err", err)
+	}
+
+	if err := db.Close(); err != nil {
+		internal.Logger.Error("Failed to close database", "err", err)
+		os.Exit(1)
 	}
+	internal.Logger.Info("Database closed")
 }
@@ -0,0 +1,30 @@
+package core
+
+// WriteBatch collects puts and deletes that DB.Apply writes atomically: after
+// a crash either all of them are recovered or none. Operations are applied in
+// the order they were added, so a later one on the same key wins.
+type WriteBatch struct {
+	ops []WALRecord
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.ops = append(b.ops, WALRecord{Type: WALRecordPut, Key: DBRecordKey(key), Value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, WALRecord{Type: WALRecordDelete, Key: DBRecordKey(key)})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = nil
+}
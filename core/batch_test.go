@@ -0,0 +1,74 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBApplyBatch(t *testing.T) {
+	db := NewLSMTStorage(WithOutDir(t.TempDir()), WithMemtableThreshold(10))
+
+	db.Write("c", []byte("value_c"))
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	batch := NewWriteBatch()
+	batch.Put("a", []byte("value_a"))
+	batch.Put("b", []byte("old"))
+	batch.Delete("c")
+	batch.Put("b", []byte("new"))
+	assert.NoError(t, db.Apply(batch))
+
+	// Every operation takes a sequence number of its own
+	assert.Equal(t, uint64(5), db.seqNumber)
+
+	results, err := db.Scan("", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyValue{{Key: "a", Value: []byte("value_a")}, {Key: "b", Value: []byte("new")}}, results)
+
+	results, err = snapshot.Scan("", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyValue{{Key: "c", Value: []byte("value_c")}}, results)
+
+	assert.NoError(t, db.Apply(NewWriteBatch()))
+	assert.Equal(t, uint64(5), db.seqNumber)
+
+	// A single oversized value rejects the whole batch
+	batch.Reset()
+	batch.Put("d", []byte("value_d"))
+	batch.Put("e", []byte(strings.Repeat("x", MAX_SCALAR_SIZE+1)))
+	assert.Error(t, db.Apply(batch))
+	_, err = db.Read("d")
+	assert.Error(t, err)
+}
+
+func TestDBApplyBatchRecovery(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	batch := NewWriteBatch()
+	batch.Put("a", []byte("value_a"))
+	batch.Put("b", []byte("value_b"))
+	assert.NoError(t, db.Apply(batch))
+
+	// Simulate a crash in the middle of logging the next batch
+	torn := WALRecord{Type: WALRecordBatch, SeqNumber: 3, Batch: []WALRecord{
+		{Type: WALRecordPut, Key: "c", Value: []byte("value_c")},
+		{Type: WALRecordDelete, Key: "a"},
+	}}
+	encoded, err := torn.MarshalBinary()
+	assert.NoError(t, err)
+	_, err = db.wal.file.Write(encoded[:len(encoded)-2])
+	assert.NoError(t, err)
+	crash(t, db)
+
+	recovered := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+	t.Cleanup(func() { recovered.Close() })
+	assert.Equal(t, uint64(2), recovered.seqNumber)
+
+	results, err := recovered.Scan("", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyValue{{Key: "a", Value: []byte("value_a")}, {Key: "b", Value: []byte("value_b")}}, results)
+}
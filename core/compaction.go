@@ -0,0 +1,332 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/ogioldat/ttrunksdb/internal"
+)
+
+const MAX_LEVELS = 7
+
+const DEFAULT_L0_COMPACTION_TRIGGER = 4
+const DEFAULT_LEVEL_SIZE_BASE = 10 * MB
+const DEFAULT_LEVEL_SIZE_MULTIPLIER = 10
+const DEFAULT_TARGET_FILE_SIZE = 2 * MB
+
+// CompactionJob merges its input tables into new tables at OutputLevel.
+type CompactionJob struct {
+	Level       int
+	OutputLevel int
+	Inputs      []*SSTable // Newest first, so that the newest version of a key wins
+	// Whether no older table outside the inputs overlaps them, in which case
+	// tombstones no snapshot needs have nothing left to shadow
+	Bottommost bool
+}
+
+func (c *CompactionJob) keyRange() (string, string) {
+	minKey, maxKey := c.Inputs[0].MinKey, c.Inputs[0].MaxKey
+	for _, sstable := range c.Inputs[1:] {
+		minKey = min(minKey, sstable.MinKey)
+		maxKey = max(maxKey, sstable.MaxKey)
+	}
+	return minKey, maxKey
+}
+
+// CompactionStrategy decides which tables are merged and when. PickCompaction
+// is called with the storage locked, so it may inspect the manager's tables
+// and keep state of its own. It returns nil when nothing needs compacting.
+type CompactionStrategy interface {
+	PickCompaction(m *SSTableManager) *CompactionJob
+}
+
+// WithCompactionStrategy replaces the default leveled compaction, e.g. with
+// NewSizeTieredCompactionStrategy for write-heavy workloads.
+func WithCompactionStrategy(strategy CompactionStrategy) Option {
+	return func(m *LSMTStorageConfig) {
+		m.compactionStrategy = strategy
+	}
+}
+
+// Tables returns the tables of level: level 0 in flush order, deeper levels
+// sorted by key. The slice must not be modified.
+func (m *SSTableManager) Tables(level int) []*SSTable {
+	return m.sstables[level]
+}
+
+func (m *SSTableManager) levelSize(level int) int64 {
+	var size int64
+	for _, sstable := range m.sstables[level] {
+		size += sstable.Size
+	}
+	return size
+}
+
+func (m *SSTableManager) overlapping(level int, minKey, maxKey string) []*SSTable {
+	var sstables []*SSTable
+	for _, sstable := range m.sstables[level] {
+		if sstable.Overlaps(minKey, maxKey) {
+			sstables = append(sstables, sstable)
+		}
+	}
+	return sstables
+}
+
+// bottommost reports whether any table outside the inputs of c may hold an
+// older version of a key in its range. Tables above the output level only
+// ever hold newer data.
+func (m *SSTableManager) bottommost(c *CompactionJob) bool {
+	minKey, maxKey := c.keyRange()
+	oldest := c.Inputs[0].seqNumber
+	for _, sstable := range c.Inputs {
+		oldest = min(oldest, sstable.seqNumber)
+	}
+
+	for level := c.OutputLevel; level <= m.MaxLevel(); level++ {
+		for _, sstable := range m.overlapping(level, minKey, maxKey) {
+			if slices.Contains(c.Inputs, sstable) {
+				continue
+			}
+			if level > c.OutputLevel || (level == 0 && sstable.seqNumber < oldest) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// LeveledCompactionStrategy keeps every level below 0 a sorted run of tables
+// with disjoint key ranges, each level a fixed multiple larger than the one
+// above. It favours read and space amplification.
+type LeveledCompactionStrategy struct {
+	L0CompactionTrigger int
+	LevelSizeBase       int
+	LevelSizeMultiplier int
+	// Largest key of the table last compacted on each level
+	compactPointers map[int]string
+}
+
+func NewLeveledCompactionStrategy(l0CompactionTrigger, levelSizeBase, levelSizeMultiplier int) *LeveledCompactionStrategy {
+	return &LeveledCompactionStrategy{
+		L0CompactionTrigger: l0CompactionTrigger,
+		LevelSizeBase:       levelSizeBase,
+		LevelSizeMultiplier: levelSizeMultiplier,
+		compactPointers:     make(map[int]string),
+	}
+}
+
+// levelTargetSize returns the size level may grow to before its tables are
+// pushed down into the next level.
+func (l *LeveledCompactionStrategy) levelTargetSize(level int) int64 {
+	size := int64(l.LevelSizeBase)
+	for range level - 1 {
+		size *= int64(l.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// PickCompaction compacts level 0 as a whole once it holds too many tables.
+// Any deeper level over its target size pushes one table down, taking turns
+// over its key range.
+func (l *LeveledCompactionStrategy) PickCompaction(m *SSTableManager) *CompactionJob {
+	var c *CompactionJob
+
+	if len(m.Tables(0)) >= l.L0CompactionTrigger {
+		c = &CompactionJob{Level: 0, OutputLevel: 1}
+		c.Inputs = slices.Clone(m.Tables(0))
+		slices.Reverse(c.Inputs)
+	}
+
+	for level := 1; c == nil && level < MAX_LEVELS-1; level++ {
+		if m.levelSize(level) <= l.levelTargetSize(level) {
+			continue
+		}
+
+		sstable := m.Tables(level)[0]
+		for _, candidate := range m.Tables(level) {
+			if candidate.MinKey > l.compactPointers[level] {
+				sstable = candidate
+				break
+			}
+		}
+		l.compactPointers[level] = sstable.MaxKey
+
+		c = &CompactionJob{Level: level, OutputLevel: level + 1, Inputs: []*SSTable{sstable}}
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	minKey, maxKey := c.keyRange()
+	c.Inputs = append(c.Inputs, m.overlapping(c.OutputLevel, minKey, maxKey)...)
+
+	return c
+}
+
+// Compact runs compactions until every level is within its limits.
+func (s *LSMTStorage) Compact() error {
+	s.compactionMu.Lock()
+	defer s.compactionMu.Unlock()
+
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return ErrClosed
+		}
+		c := s.config.compactionStrategy.PickCompaction(s.ssTableManager)
+		if c != nil {
+			c.Bottommost = s.ssTableManager.bottommost(c)
+		}
+		// Snapshots taken later see only the newest versions, which are kept
+		snapshots := s.liveSnapshots()
+		s.mu.Unlock()
+
+		if c == nil {
+			return nil
+		}
+		if err := s.runCompaction(c, snapshots); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *LSMTStorage) compactInBackground() {
+	defer close(s.compactionDone)
+
+	for range s.compactionRequests {
+		// Close stops compacting between two jobs
+		if err := s.Compact(); err != nil && !errors.Is(err, ErrClosed) {
+			internal.Logger.Error("Compaction failed", "err", err)
+		}
+	}
+}
+
+func (s *LSMTStorage) requestCompaction() {
+	select {
+	case s.compactionRequests <- struct{}{}:
+	default:
+		// A compaction is already requested
+	}
+}
+
+// runCompaction merges the inputs of c into new tables and swaps them in,
+// keeping the versions the given snapshots still need. Inputs are only ever
+// removed by compactions, which s.compactionMu serializes, so they can be
+// read without holding s.mu.
+func (s *LSMTStorage) runCompaction(c *CompactionJob, snapshots []uint64) error {
+	var iterators []RecordIterator
+	for _, sstable := range c.Inputs {
+		iterator, err := s.ssTableManager.NewIterator(sstable)
+		if err != nil {
+			NewMergingIterator(iterators...).Close()
+			return err
+		}
+		iterators = append(iterators, iterator)
+	}
+
+	merged := newRetainingIterator(NewMergingIterator(iterators...), snapshots, c.Bottommost)
+	defer merged.Close()
+
+	var outputs []*SSTable
+	var records []DBRecord
+	size := 0
+
+	writeOutput := func() error {
+		s.mu.Lock()
+		sstable := s.ssTableManager.NewSSTable(s.config, c.OutputLevel)
+		s.mu.Unlock()
+
+		if c.OutputLevel == 0 {
+			// Level 0 is read in age order, so the output takes the place of
+			// its newest input
+			sstable.seqNumber = c.Inputs[0].seqNumber
+			for _, input := range c.Inputs {
+				sstable.seqNumber = max(sstable.seqNumber, input.seqNumber)
+			}
+		}
+
+		outputs = append(outputs, sstable)
+		if err := s.ssTableManager.WriteRecords(sstable, records); err != nil {
+			return err
+		}
+
+		records = nil
+		size = 0
+		return nil
+	}
+
+	err := func() error {
+		for {
+			record, err := merged.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			// Level 0 tables may overlap each other, so they are never split.
+			// Other levels split only between keys: all versions of a key stay
+			// in one table, so the key ranges of a level remain disjoint.
+			if c.OutputLevel > 0 && size >= s.config.targetFileSize && records[len(records)-1].Key != record.Key {
+				if err := writeOutput(); err != nil {
+					return err
+				}
+			}
+
+			records = append(records, *record)
+			size += s.ssTableManager.serializer.RecordSize(record.Key, record.Value)
+		}
+
+		if len(records) > 0 {
+			return writeOutput()
+		}
+		return nil
+	}()
+
+	edit := &VersionEdit{}
+	for _, sstable := range outputs {
+		edit.AddedTables = append(edit.AddedTables, sstable.Metadata())
+	}
+	for _, sstable := range c.Inputs {
+		edit.RemovedTables = append(edit.RemovedTables, sstable.Metadata())
+	}
+
+	if err == nil {
+		s.mu.Lock()
+		err = s.ssTableManager.LogAndApply(edit)
+		s.mu.Unlock()
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		for _, sstable := range outputs {
+			s.ssTableManager.discard(sstable)
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	internal.Logger.Info(
+		"Compaction finished",
+		"level", c.Level,
+		"outputLevel", c.OutputLevel,
+		"inputs", len(c.Inputs),
+		"outputs", len(outputs),
+	)
+
+	// Readers hold s.mu while they use a table, so once the edit is applied
+	// no one can still be reading the inputs
+	for _, sstable := range c.Inputs {
+		if err := os.Remove(sstable.Path); err != nil {
+			internal.Logger.Warn("Failed to remove obsolete SSTable", "sstable", sstable.Path, "err", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package core
+
+import "slices"
+
+const DEFAULT_STCS_MIN_THRESHOLD = 4
+const DEFAULT_STCS_MAX_THRESHOLD = 32
+const DEFAULT_STCS_BUCKET_LOW = 0.5
+const DEFAULT_STCS_BUCKET_HIGH = 1.5
+const DEFAULT_STCS_MIN_SSTABLE_SIZE = 1 * MB
+
+// SizeTieredCompactionStrategy merges tables of similar size into one larger
+// table, so that every record is rewritten only a few times. It favours write
+// amplification over read and space amplification. All tables stay in level 0.
+type SizeTieredCompactionStrategy struct {
+	// Tables a bucket needs before it is compacted
+	MinThreshold int
+	// Tables compacted at most at once
+	MaxThreshold int
+	// A table joins a bucket when its size is within these fractions of the
+	// bucket's average size
+	BucketLow  float64
+	BucketHigh float64
+	// Tables smaller than this all share a bucket
+	MinSSTableSize int64
+}
+
+func NewSizeTieredCompactionStrategy() *SizeTieredCompactionStrategy {
+	return &SizeTieredCompactionStrategy{
+		MinThreshold:   DEFAULT_STCS_MIN_THRESHOLD,
+		MaxThreshold:   DEFAULT_STCS_MAX_THRESHOLD,
+		BucketLow:      DEFAULT_STCS_BUCKET_LOW,
+		BucketHigh:     DEFAULT_STCS_BUCKET_HIGH,
+		MinSSTableSize: DEFAULT_STCS_MIN_SSTABLE_SIZE,
+	}
+}
+
+func (s *SizeTieredCompactionStrategy) fits(bucket []*SSTable, sstable *SSTable) bool {
+	var total int64
+	for _, member := range bucket {
+		total += member.Size
+	}
+	average := float64(total) / float64(len(bucket))
+
+	if average < float64(s.MinSSTableSize) && sstable.Size < s.MinSSTableSize {
+		return true
+	}
+	size := float64(sstable.Size)
+	return size >= average*s.BucketLow && size <= average*s.BucketHigh
+}
+
+// buckets groups the level 0 tables by size. Only tables adjacent in age
+// share a bucket: a merged table takes the place of its newest input, which
+// would be wrong if a table of a different bucket was flushed in between.
+func (s *SizeTieredCompactionStrategy) buckets(m *SSTableManager) [][]*SSTable {
+	var buckets [][]*SSTable
+	var bucket []*SSTable
+
+	for _, sstable := range m.Tables(0) {
+		if len(bucket) > 0 && !s.fits(bucket, sstable) {
+			buckets = append(buckets, bucket)
+			bucket = nil
+		}
+		bucket = append(bucket, sstable)
+	}
+	if len(bucket) > 0 {
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+// PickCompaction merges the bucket of the smallest tables among those that
+// reached MinThreshold, which is the cheapest way to cut the table count.
+func (s *SizeTieredCompactionStrategy) PickCompaction(m *SSTableManager) *CompactionJob {
+	var picked []*SSTable
+	var pickedSize int64
+
+	for _, bucket := range s.buckets(m) {
+		if len(bucket) < s.MinThreshold {
+			continue
+		}
+		// The oldest tables of an oversized bucket go first
+		bucket = bucket[:min(len(bucket), s.MaxThreshold)]
+
+		var size int64
+		for _, sstable := range bucket {
+			size += sstable.Size
+		}
+		if picked == nil || size/int64(len(bucket)) < pickedSize/int64(len(picked)) {
+			picked, pickedSize = bucket, size
+		}
+	}
+
+	if picked == nil {
+		return nil
+	}
+
+	inputs := slices.Clone(picked)
+	slices.Reverse(inputs)
+	return &CompactionJob{Level: 0, OutputLevel: 0, Inputs: inputs}
+}
@@ -0,0 +1,270 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCompactionTestStorage(t *testing.T, dir string, opts ...Option) *LSMTStorage {
+	db := NewLSMTStorage(append([]Option{WithOutDir(dir)}, opts...)...)
+	// Waits for a background compaction that may still be running. Tests
+	// that reopen dir close db themselves first.
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableFiles(t *testing.T, dir string, level int) []string {
+	entries, err := os.ReadDir(path.Join(dir, "sstables", fmt.Sprintf("level_%d", level)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	assert.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestCompactLevel0IntoLevel1(t *testing.T) {
+	tempDir := t.TempDir()
+	db := newCompactionTestStorage(t, tempDir, WithMemtableThreshold(2), WithL0CompactionTrigger(2))
+
+	db.Write("a", []byte("old"))
+	db.Write("b", []byte("value_b"))
+	db.Write("a", []byte("new"))
+	db.Write("c", []byte("value_c"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	assert.Empty(t, db.ssTableManager.sstables[0])
+	assert.Len(t, db.ssTableManager.sstables[1], 1)
+	assert.Equal(t, "a", db.ssTableManager.sstables[1][0].MinKey)
+	assert.Equal(t, "c", db.ssTableManager.sstables[1][0].MaxKey)
+
+	// The obsolete inputs are removed
+	assert.Empty(t, tableFiles(t, tempDir, 0))
+	assert.Equal(t, []string{db.ssTableManager.sstables[1][0].Name + ".bin"}, tableFiles(t, tempDir, 1))
+
+	for key, expected := range map[string]string{"a": "new", "b": "value_b", "c": "value_c"} {
+		value, err := db.Read(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+}
+
+func TestCompactDropsTombstonesAtBottomLevel(t *testing.T) {
+	tempDir := t.TempDir()
+	db := newCompactionTestStorage(t, tempDir, WithMemtableThreshold(2), WithL0CompactionTrigger(2))
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+	db.Delete("a")
+	db.Write("c", []byte("value_c"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	_, err := db.Read("a")
+	assert.Error(t, err)
+
+	iterator, err := db.ssTableManager.NewIterator(db.ssTableManager.sstables[1][0])
+	assert.NoError(t, err)
+
+	var keys []DBRecordKey
+	for _, record := range collect(t, iterator) {
+		keys = append(keys, record.Key)
+	}
+	assert.Equal(t, []DBRecordKey{"b", "c"}, keys)
+}
+
+func TestCompactPushesLevelsDown(t *testing.T) {
+	tempDir := t.TempDir()
+	opts := []Option{
+		WithMemtableThreshold(10),
+		// Every flushed table is compacted, however the background
+		// compactions interleave with the flushes
+		WithL0CompactionTrigger(1),
+		// Level 1 is always over its target, level 2 never is
+		WithLevelSizeBase(1),
+		WithLevelSizeMultiplier(1 * MB),
+		WithTargetFileSize(100),
+	}
+	db := newCompactionTestStorage(t, tempDir, opts...)
+
+	for i := range 40 {
+		db.Write(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	assert.Empty(t, db.ssTableManager.sstables[0])
+	assert.Empty(t, db.ssTableManager.sstables[1])
+
+	// Deeper levels are split into tables with disjoint, sorted key ranges
+	level2 := db.ssTableManager.sstables[2]
+	assert.Greater(t, len(level2), 1)
+	for i := 1; i < len(level2); i++ {
+		assert.Less(t, level2[i-1].MaxKey, level2[i].MinKey)
+	}
+
+	assert.NoError(t, db.Close())
+	restarted := newCompactionTestStorage(t, tempDir, opts...)
+	assert.Len(t, restarted.ssTableManager.sstables[2], len(level2))
+	for i := range 40 {
+		value, err := restarted.Read(fmt.Sprintf("key%02d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+	}
+}
+
+func TestCompactKeepsVersionsOfAKeyInOneTable(t *testing.T) {
+	db := newCompactionTestStorage(t, t.TempDir(), WithMemtableThreshold(8), WithL0CompactionTrigger(1), WithTargetFileSize(100))
+
+	// Every version is retained by a snapshot, so together they outgrow an
+	// output table
+	var snapshots []*Snapshot
+	for i := range 7 {
+		db.Write("k", []byte(fmt.Sprintf("value%d", i)))
+		snapshot := db.Snapshot()
+		defer snapshot.Release()
+		snapshots = append(snapshots, snapshot)
+	}
+	db.Write("l", []byte("value_l"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	assert.Empty(t, db.ssTableManager.sstables[0])
+	level1 := db.ssTableManager.sstables[1]
+	assert.NotEmpty(t, level1)
+	for i := 1; i < len(level1); i++ {
+		assert.Less(t, level1[i-1].MaxKey, level1[i].MinKey)
+	}
+
+	for i, snapshot := range snapshots {
+		value, err := snapshot.Read("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+	}
+}
+
+func addTestTable(manager *SSTableManager, cfg *LSMTStorageConfig, level int, minKey, maxKey string, size int64) *SSTable {
+	sstable := manager.NewSSTable(cfg, level)
+	sstable.MinKey, sstable.MaxKey, sstable.Size = minKey, maxKey, size
+	delete(manager.pending, sstable.Name)
+	manager.register(sstable)
+	return sstable
+}
+
+func TestLeveledCompactionStrategy(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+	manager := NewSSTableManager(cfg)
+	strategy := NewLeveledCompactionStrategy(2, 100, 10)
+
+	older := addTestTable(manager, cfg, 0, "a", "f", 10)
+	assert.Nil(t, strategy.PickCompaction(manager))
+
+	newer := addTestTable(manager, cfg, 0, "e", "k", 10)
+	overlapping := addTestTable(manager, cfg, 1, "j", "m", 10)
+	addTestTable(manager, cfg, 1, "n", "z", 10)
+	addTestTable(manager, cfg, 2, "a", "c", 10)
+
+	c := strategy.PickCompaction(manager)
+	assert.Equal(t, 1, c.OutputLevel)
+	assert.Equal(t, []*SSTable{newer, older, overlapping}, c.Inputs)
+	// Level 2 still holds keys in the compacted range
+	assert.False(t, manager.bottommost(c))
+
+	manager.sstables[0] = nil
+	assert.Nil(t, strategy.PickCompaction(manager))
+
+	// Level 1 over its target pushes its tables down one at a time
+	overlapping.Size = 100
+	c = strategy.PickCompaction(manager)
+	assert.Equal(t, 2, c.OutputLevel)
+	assert.Equal(t, []*SSTable{overlapping}, c.Inputs)
+	assert.True(t, manager.bottommost(c))
+
+	c = strategy.PickCompaction(manager)
+	assert.Equal(t, "n", c.Inputs[0].MinKey)
+}
+
+func TestSizeTieredCompactionStrategy(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+	manager := NewSSTableManager(cfg)
+	strategy := NewSizeTieredCompactionStrategy()
+	strategy.MinThreshold = 3
+	strategy.MinSSTableSize = 10
+
+	large := addTestTable(manager, cfg, 0, "a", "z", 1000)
+	addTestTable(manager, cfg, 0, "a", "z", 1200)
+	small := []*SSTable{
+		addTestTable(manager, cfg, 0, "a", "m", 100),
+		addTestTable(manager, cfg, 0, "c", "p", 120),
+	}
+	assert.Nil(t, strategy.PickCompaction(manager))
+
+	small = append(small, addTestTable(manager, cfg, 0, "b", "k", 90))
+	c := strategy.PickCompaction(manager)
+	assert.Equal(t, 0, c.OutputLevel)
+	assert.Equal(t, []*SSTable{small[2], small[1], small[0]}, c.Inputs)
+	// The large tables are older and may still hold keys the inputs delete
+	assert.False(t, manager.bottommost(c))
+
+	// With both buckets full, the one of smaller tables goes first
+	strategy.MinThreshold = 2
+	c = strategy.PickCompaction(manager)
+	assert.Equal(t, []*SSTable{small[2], small[1], small[0]}, c.Inputs)
+
+	strategy.MinThreshold = 3
+	manager.sstables[0] = manager.sstables[0][:2]
+	addTestTable(manager, cfg, 0, "a", "z", 900)
+	c = strategy.PickCompaction(manager)
+	assert.Len(t, c.Inputs, 3)
+	assert.Equal(t, large, c.Inputs[2])
+	assert.True(t, manager.bottommost(c))
+}
+
+func TestCompactSizeTiered(t *testing.T) {
+	tempDir := t.TempDir()
+	strategy := NewSizeTieredCompactionStrategy()
+	strategy.MinThreshold = 2
+	opts := []Option{WithMemtableThreshold(2), WithCompactionStrategy(strategy)}
+	db := newCompactionTestStorage(t, tempDir, opts...)
+
+	db.Write("a", []byte("old"))
+	db.Write("b", []byte("value_b"))
+	db.Delete("b")
+	db.Write("a", []byte("new"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	assert.Len(t, db.ssTableManager.sstables[0], 1)
+	assert.Empty(t, db.ssTableManager.sstables[1])
+
+	value, err := db.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+	_, err = db.Read("b")
+	assert.Error(t, err)
+
+	// The merged table keeps its place in age order after a restart
+	db.mu.Lock()
+	strategy.MinThreshold = 3
+	db.mu.Unlock()
+	db.Write("a", []byte("newest"))
+	db.Write("c", []byte("value_c"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+	assert.Len(t, db.ssTableManager.sstables[0], 2)
+
+	assert.NoError(t, db.Close())
+	restarted := newCompactionTestStorage(t, tempDir, opts...)
+	value, err = restarted.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newest"), value)
+}
@@ -1,9 +1,13 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"slices"
+	"sync"
+	"time"
 
 	"github.com/ogioldat/ttrunksdb/internal"
 )
@@ -25,14 +29,31 @@ type DBRecord struct {
 	Value     DBRecordValue
 	Timestamp DBRecordTimestamp
 	Tombstone DBRecordTombstone
+	SeqNumber uint64
 }
 
 const MAX_SCALAR_SIZE = 1 * KB
 
+var ErrClosed = errors.New("storage closed")
+
+// KeyValue is a single result of a scan.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
 type DB interface {
 	Read(string) ([]byte, error)
 	Write(string, []byte) error
+	Delete(string) error
+	Apply(*WriteBatch) error
+	Begin() *Txn
+	Stats() Stats
+	Close() error
 	Iter(yield func(key string, value []byte) bool)
+	Scan(start, end string, limit int) ([]KeyValue, error)
+	ScanPrefix(prefix string) ([]KeyValue, error)
+	Snapshot() *Snapshot
 }
 
 type Option func(*LSMTStorageConfig)
@@ -43,30 +64,180 @@ func WithOutDir(dir string) Option {
 	}
 }
 
+// WithSSTableBloomFilterSize gives every SSTable a bloom filter of size bits,
+// instead of sizing it by the table's key count.
 func WithSSTableBloomFilterSize(size int) Option {
 	return func(m *LSMTStorageConfig) {
 		m.sstableBloomFilterSize = size
 	}
 }
 
+// WithBloomBitsPerKey sizes the bloom filter of each SSTable at bitsPerKey
+// bits per key it holds. 10 bits give a false positive rate of about 1%.
+func WithBloomBitsPerKey(bitsPerKey int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.bloomBitsPerKey = bitsPerKey
+	}
+}
+
+// WithSSTableBlockSize sets the size of the blocks SSTables are split into.
+// The sparse index holds one key per block and a lookup reads a single block.
+func WithSSTableBlockSize(size int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.sstableBlockSize = size
+	}
+}
+
+// WithMemtableThreshold flushes the memtable once it holds th records, the
+// older versions kept for snapshots included. It is off by default, leaving
+// flushes to the size set with WithMemtableSize.
 func WithMemtableThreshold(th int) Option {
 	return func(m *LSMTStorageConfig) {
 		m.memTableThreshold = th
 	}
 }
 
+// WithMemTableType selects the memtable implementation, MemTableRBTree by
+// default.
+func WithMemTableType(memTableType MemTableType) Option {
+	return func(m *LSMTStorageConfig) {
+		m.memTableType = memTableType
+	}
+}
+
+// WithMemtableSize sets the approximate memory in bytes the memtable may take
+// before it is flushed, DEFAULT_MEMTABLE_SIZE by default. When an entry
+// threshold is set too, the memtable is flushed as soon as either is reached.
+func WithMemtableSize(size int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.memTableSize = size
+	}
+}
+
+// WithWALArchiveDir moves WAL segments into dir once they are no longer
+// needed for recovery, instead of deleting them.
+func WithWALArchiveDir(dir string) Option {
+	return func(m *LSMTStorageConfig) {
+		m.walArchiveDir = dir
+	}
+}
+
+// WithWALSyncMode sets when WAL records are fsynced, see WALSyncMode.
+func WithWALSyncMode(mode WALSyncMode) Option {
+	return func(m *LSMTStorageConfig) {
+		m.walSyncMode = mode
+	}
+}
+
+// WithWALSyncInterval sets how often WALSyncInterval fsyncs the WAL.
+func WithWALSyncInterval(interval time.Duration) Option {
+	return func(m *LSMTStorageConfig) {
+		m.walSyncInterval = interval
+	}
+}
+
+// WithWALSyncBytes sets how many bytes WALSyncGroup lets accumulate before
+// fsyncing the WAL.
+func WithWALSyncBytes(size int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.walSyncBytes = size
+	}
+}
+
+// WithMaxImmutableMemtables sets how many full memtables may wait for the
+// background flush. Writers block once that many are queued.
+func WithMaxImmutableMemtables(n int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.maxImmutableMemTables = n
+	}
+}
+
+// WithL0CompactionTrigger sets how many level 0 tables trigger a compaction
+// into level 1 with the default leveled compaction.
+func WithL0CompactionTrigger(n int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.l0CompactionTrigger = n
+	}
+}
+
+// WithLevelSizeBase sets the target size of level 1 in bytes with the
+// default leveled compaction.
+func WithLevelSizeBase(size int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.levelSizeBase = size
+	}
+}
+
+// WithLevelSizeMultiplier sets how many times larger each level is than the
+// one above it.
+func WithLevelSizeMultiplier(multiplier int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.levelSizeMultiplier = multiplier
+	}
+}
+
+// WithTargetFileSize sets the size at which compaction starts a new output
+// table.
+func WithTargetFileSize(size int) Option {
+	return func(m *LSMTStorageConfig) {
+		m.targetFileSize = size
+	}
+}
+
 type LSMTStorageConfig struct {
-	memTableThreshold      int // Max size of entries in the memtable before flushing to SSTables
+	memTableThreshold      int // Max entries in the memtable before flushing to SSTables, 0 for no limit
+	memTableSize           int // Max bytes taken by the memtable before flushing to SSTables
+	memTableType           MemTableType
+	maxImmutableMemTables  int
 	outputDir              string
-	sstableBloomFilterSize int
+	sstableBloomFilterSize int // Fixed bloom filter size in bits, 0 to size by key count
+	bloomBitsPerKey        int
+	sstableBlockSize       int
+	walArchiveDir          string
+	walSyncMode            WALSyncMode
+	walSyncInterval        time.Duration
+	walSyncBytes           int
+	l0CompactionTrigger    int
+	levelSizeBase          int
+	levelSizeMultiplier    int
+	targetFileSize         int
+	compactionStrategy     CompactionStrategy
+}
+
+const DEFAULT_MAX_IMMUTABLE_MEMTABLES = 2
+const DEFAULT_MEMTABLE_SIZE = 4 * MB
+
+// immutableMemTable is a full memtable waiting to be flushed to an SSTable.
+type immutableMemTable struct {
+	memTable  MemTable
+	segment   uint64 // Last WAL segment holding records of the memtable
+	seqNumber uint64 // Sequence number of the newest record in the memtable
 }
 
+// LSMTStorage is safe for concurrent use. Reads, scans and iterations share
+// mu and run in parallel; writes hold it exclusively and are serialized. A
+// full memtable is swapped for an empty one under mu and stays readable until
+// its SSTable is live, so a read never misses a write on its way to disk.
 type LSMTStorage struct {
-	config         *LSMTStorageConfig
-	seqNumber      int
-	memTable       MemTable
+	config        *LSMTStorageConfig
+	mu            sync.RWMutex
+	seqNumber     uint64
+	memTable      MemTable
+	immutables    []*immutableMemTable // Oldest first
+	flushed       *sync.Cond           // Signalled whenever an immutable memtable is flushed
+	flushRequests chan struct{}
+	flushErr      error
+	// Serializes compactions, both background and manual ones
+	compactionMu       sync.Mutex
+	compactionRequests chan struct{}
+	// Live snapshots by sequence number, counted as several may share one
+	snapshots      map[uint64]int
 	ssTableManager *SSTableManager
 	wal            *WAL
+	closed         bool
+	// Closed once the background goroutines exit
+	flushDone      chan struct{}
+	compactionDone chan struct{}
 }
 
 func NewLSMTStorage(opts ...Option) *LSMTStorage {
@@ -76,27 +247,102 @@ func NewLSMTStorage(opts ...Option) *LSMTStorage {
 	}
 
 	config := &LSMTStorageConfig{
-		memTableThreshold:      1000,
-		outputDir:              outputDir,
-		sstableBloomFilterSize: 10000,
+		memTableSize:          DEFAULT_MEMTABLE_SIZE,
+		maxImmutableMemTables: DEFAULT_MAX_IMMUTABLE_MEMTABLES,
+		outputDir:             outputDir,
+		bloomBitsPerKey:       DEFAULT_BLOOM_BITS_PER_KEY,
+		sstableBlockSize:      DEFAULT_SSTABLE_BLOCK_SIZE,
+		walSyncMode:           WALSyncInterval,
+		walSyncInterval:       DEFAULT_WAL_SYNC_INTERVAL,
+		walSyncBytes:          DEFAULT_WAL_SYNC_BYTES,
+		l0CompactionTrigger:   DEFAULT_L0_COMPACTION_TRIGGER,
+		levelSizeBase:         DEFAULT_LEVEL_SIZE_BASE,
+		levelSizeMultiplier:   DEFAULT_LEVEL_SIZE_MULTIPLIER,
+		targetFileSize:        DEFAULT_TARGET_FILE_SIZE,
 	}
 
 	for _, opt := range opts {
 		opt(config)
 	}
 
+	if config.compactionStrategy == nil {
+		config.compactionStrategy = NewLeveledCompactionStrategy(
+			config.l0CompactionTrigger,
+			config.levelSizeBase,
+			config.levelSizeMultiplier,
+		)
+	}
+
 	wal, err := NewWAL(config)
 	if err != nil {
 		panic(fmt.Sprintf("failed to create WAL: %v", err))
 	}
 
-	return &LSMTStorage{
-		config:         config,
-		seqNumber:      0,
-		memTable:       NewRBMemTable(),
-		ssTableManager: NewSSTableManager(config),
-		wal:            wal,
+	storage := &LSMTStorage{
+		config:             config,
+		seqNumber:          0,
+		memTable:           NewMemTable(config.memTableType),
+		ssTableManager:     NewSSTableManager(config),
+		wal:                wal,
+		flushRequests:      make(chan struct{}, 1),
+		compactionRequests: make(chan struct{}, 1),
+		snapshots:          make(map[uint64]int),
+		flushDone:          make(chan struct{}),
+		compactionDone:     make(chan struct{}),
+	}
+	storage.flushed = sync.NewCond(&storage.mu)
+
+	if err := storage.ssTableManager.Load(); err != nil {
+		panic(fmt.Sprintf("failed to load SSTables: %v", err))
+	}
+
+	if err := storage.recover(); err != nil {
+		panic(fmt.Sprintf("failed to recover WAL: %v", err))
 	}
+
+	go storage.flushInBackground()
+	go storage.compactInBackground()
+	// Tables left over from the last run may already need compacting
+	storage.requestCompaction()
+
+	return storage
+}
+
+// recover rebuilds the memtable from writes that were logged to the WAL
+// but not yet flushed to an SSTable.
+func (s *LSMTStorage) recover() error {
+	s.seqNumber = s.ssTableManager.LastSequence()
+
+	// Segments below the log number were flushed, but the crash came before
+	// they were released
+	if logNumber := s.ssTableManager.LogNumber(); logNumber > 0 {
+		if err := s.wal.Release(logNumber - 1); err != nil {
+			return err
+		}
+	}
+
+	replayed, err := s.wal.Replay(func(record *WALRecord) error {
+		for _, op := range record.Ops() {
+			if op.Type != WALRecordPut && op.Type != WALRecordDelete {
+				return fmt.Errorf("unsupported WAL record type: %d", op.Type)
+			}
+			// No snapshot outlives a restart
+			if err := s.memTable.Apply(op.DBRecord(), 0); err != nil {
+				return err
+			}
+			s.seqNumber = max(s.seqNumber, op.SeqNumber)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if replayed > 0 {
+		internal.Logger.Info("Recovered memtable from WAL", "entries", replayed)
+	}
+
+	return nil
 }
 
 func (s *LSMTStorage) updateSeq() {
@@ -108,86 +354,422 @@ func (s *LSMTStorage) Write(key string, value []byte) error {
 		return fmt.Errorf("value size exceeds maximum allowed size of %d bytes", MAX_SCALAR_SIZE)
 	}
 
-	err := s.wal.Log(key, string(value))
+	return s.write(WALRecord{
+		Type:  WALRecordPut,
+		Key:   DBRecordKey(key),
+		Value: value,
+	})
+}
+
+// Delete writes a tombstone for key. Reads of the key report it as missing
+// from then on, even if older SSTables still hold a value for it.
+func (s *LSMTStorage) Delete(key string) error {
+	return s.write(WALRecord{
+		Type: WALRecordDelete,
+		Key:  DBRecordKey(key),
+	})
+}
+
+// Apply writes every operation of batch under a single WAL record, taking
+// consecutive sequence numbers. Readers see either none or all of them.
+func (s *LSMTStorage) Apply(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	for _, op := range batch.ops {
+		if len(op.Value) > MAX_SCALAR_SIZE {
+			return fmt.Errorf("value size of %s exceeds maximum allowed size of %d bytes", op.Key, MAX_SCALAR_SIZE)
+		}
+	}
+
+	return s.write(WALRecord{
+		Type:  WALRecordBatch,
+		Batch: batch.ops,
+	})
+}
+
+func (s *LSMTStorage) write(record WALRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeLocked(record)
+}
+
+// writeLocked logs record and applies it to the memtable. s.mu must be held.
+func (s *LSMTStorage) writeLocked(record WALRecord) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.flushErr != nil {
+		return fmt.Errorf("background flush failed: %w", s.flushErr)
+	}
+
+	record.SeqNumber = s.seqNumber + 1
+	record.Timestamp = DBRecordTimestamp(time.Now().Unix())
+
+	err := s.wal.Log(record)
 
 	if err != nil {
-		internal.Logger.Debug("WAL log failed", "key", key, "value", value, "err", err)
+		internal.Logger.Debug("WAL log failed", "key", record.Key, "ops", len(record.Batch), "err", err)
 		return err
 	}
 
-	if err := s.memTable.Append(key, []byte(value)); err != nil {
-		internal.Logger.Debug("Memtable write failed", "key", key, "value", value, "err", err)
+	lastSnapshot := s.lastSnapshot()
+	for _, op := range record.Ops() {
+		if err := s.memTable.Apply(op.DBRecord(), lastSnapshot); err != nil {
+			internal.Logger.Debug("Memtable write failed", "key", op.Key, "value", op.Value, "err", err)
+			return err
+		}
+
+		internal.Logger.Debug("Write to memtable", "key", op.Key, "value", op.Value, "tombstone", op.Type == WALRecordDelete)
+
+		s.updateSeq()
+	}
+
+	// A batch is never split across memtables
+	if s.memTableFull() {
+		return s.freezeMemTable()
+	}
+
+	return nil
+}
+
+func (s *LSMTStorage) memTableFull() bool {
+	return (s.config.memTableThreshold > 0 && s.config.memTableThreshold <= s.memTable.Size()) ||
+		s.config.memTableSize <= s.memTable.ApproximateSize()
+}
+
+// freezeMemTable queues the full memtable for the background flush and swaps
+// in an empty one. It blocks while the queue is full. Writers stalled on the
+// same memtable all wake up, but only the first one still finds it full and
+// freezes it. A writer that wakes up after Close started leaves the memtable,
+// its write included, to Close and fails with ErrClosed. s.mu must be held.
+func (s *LSMTStorage) freezeMemTable() error {
+	for len(s.immutables) >= s.config.maxImmutableMemTables && s.flushErr == nil {
+		internal.Logger.Debug("Write stalled, waiting for memtable flush", "immutables", len(s.immutables))
+		s.flushed.Wait()
+		if s.closed {
+			return ErrClosed
+		}
+		if !s.memTableFull() {
+			return nil
+		}
+	}
+	if s.flushErr != nil {
+		return fmt.Errorf("background flush failed: %w", s.flushErr)
+	}
+
+	// Records logged from now on belong to the next memtable
+	segment, err := s.wal.Rotate()
+	if err != nil {
+		internal.Logger.Debug("WAL rotation failed", "err", err)
 		return err
 	}
 
-	internal.Logger.Debug("Write to memtable", "key", key, "value", value)
+	s.immutables = append(s.immutables, &immutableMemTable{
+		memTable:  s.memTable,
+		segment:   segment,
+		seqNumber: s.seqNumber,
+	})
+	s.memTable = NewMemTable(s.config.memTableType)
+
+	select {
+	case s.flushRequests <- struct{}{}:
+	default:
+		// A flush is already requested and will pick this memtable up
+	}
 
-	s.updateSeq()
+	return nil
+}
+
+func (s *LSMTStorage) flushInBackground() {
+	defer close(s.flushDone)
+
+	for range s.flushRequests {
+		if err := s.flushImmutables(); err != nil {
+			internal.Logger.Error("Memtable flush failed", "err", err)
+			s.mu.Lock()
+			s.flushErr = err
+			s.flushed.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
 
-	// TODO: Move as a background task
-	if s.config.memTableThreshold <= s.memTable.Size() {
-		sstable := s.ssTableManager.AddSSTable(s.config)
-		if err := s.ssTableManager.Flush(sstable, s.memTable); err != nil {
+// flushImmutables writes the queued memtables to SSTables, oldest first.
+// Reads keep being served from a memtable until its SSTable is live.
+func (s *LSMTStorage) flushImmutables() error {
+	for {
+		s.mu.Lock()
+		if len(s.immutables) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		imm := s.immutables[0]
+		sstable := s.ssTableManager.NewSSTable(s.config, 0)
+		snapshots := s.liveSnapshots()
+		s.mu.Unlock()
+
+		records, err := collectRecords(newRetainingIterator(NewMemTableIterator(imm.memTable), snapshots, false))
+		if err == nil {
+			err = s.ssTableManager.WriteRecords(sstable, records)
+		}
+		if err != nil {
 			internal.Logger.Debug("Memtable flush failed", "sstable", sstable.Name, "err", err)
 			return err
 		}
+
+		s.mu.Lock()
+		err = s.ssTableManager.LogAndApply(&VersionEdit{
+			AddedTables:  []TableMetadata{sstable.Metadata()},
+			LastSequence: imm.seqNumber,
+			LogNumber:    imm.segment + 1,
+		})
+		if err == nil {
+			s.immutables = s.immutables[1:]
+			s.flushed.Broadcast()
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			internal.Logger.Debug("MANIFEST update failed", "sstable", sstable.Name, "err", err)
+			return err
+		}
 		internal.Logger.Debug("Memtable flushed to SSTable", "sstable", sstable.Name)
-		s.memTable.Reset()
+		s.requestCompaction()
+
+		if err := s.wal.Release(imm.segment); err != nil {
+			return err
+		}
 	}
+}
 
-	return nil
+// Close flushes the memtable, waits for the background flush and compaction
+// to finish and releases the WAL and the MANIFEST. Every call on s fails with
+// ErrClosed afterwards, including a second Close.
+func (s *LSMTStorage) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+
+	// Waits for room in the queue first: after a wait, freezeMemTable leaves
+	// a memtable that is not full alone
+	for len(s.immutables) >= s.config.maxImmutableMemTables && s.flushErr == nil {
+		s.flushed.Wait()
+	}
+	var err error
+	if s.memTable.Size() > 0 && s.flushErr == nil {
+		err = s.freezeMemTable()
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		err = s.waitForFlushes()
+	}
+
+	return errors.Join(err, s.shutdown())
 }
 
-func (s *LSMTStorage) Compact(key string) ([]byte, error) {
-	return nil, nil
+// shutdown stops the background flush and compaction and releases the WAL
+// and the MANIFEST. s.closed must be set.
+func (s *LSMTStorage) shutdown() error {
+	// The flush goroutine requests compactions, so it has to stop first
+	close(s.flushRequests)
+	<-s.flushDone
+	close(s.compactionRequests)
+	<-s.compactionDone
+
+	return errors.Join(s.wal.Close(), s.ssTableManager.Close())
+}
+
+// waitForFlushes blocks until every queued memtable is flushed.
+func (s *LSMTStorage) waitForFlushes() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.immutables) > 0 && s.flushErr == nil {
+		s.flushed.Wait()
+	}
+	return s.flushErr
 }
 
 func (s *LSMTStorage) Read(key string) ([]byte, error) {
-	if value, ok := s.memTable.Read(key); ok {
-		internal.Logger.Debug("Read from memtable", "key", key, "value", value, "ok", ok)
-		return value, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readAt(key, s.seqNumber)
+}
+
+// readAt returns the value key had as of seqNumber. s.mu must be held.
+func (s *LSMTStorage) readAt(key string, seqNumber uint64) ([]byte, error) {
+	if s.closed {
+		return nil, ErrClosed
 	}
 
-	sstable := s.ssTableManager.FindByKey(key)
+	for _, memTable := range s.memTables() {
+		if node := memTable.GetAt(key, seqNumber); node != nil {
+			internal.Logger.Debug("Read from memtable", "key", key, "value", node.Value, "tombstone", node.Metadata.Tombstone)
+			if node.Metadata.Tombstone {
+				return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+			}
+			return node.Value, nil
+		}
+	}
+
+	record, sstable, err := s.ssTableManager.FindAt(key, seqNumber)
 
-	if sstable == nil {
+	if err != nil {
+		internal.Logger.Debug("Failed to read from sstable", "sstable", sstable.Path, "key", key, "err", err)
+		return nil, err
+	}
+
+	if record == nil {
 		internal.Logger.Debug("Failed to find sstable", "key", key)
-		return nil, fmt.Errorf("sstable not found: %s", key)
+		return nil, fmt.Errorf("%w: sstable not found: %s", ErrKeyNotFound, key)
 	}
 
-	record, err := s.ssTableManager.Read(sstable, key)
+	internal.Logger.Debug("Read from sstable", "sstable", sstable.Path, "key", key, "value", record.Value, "tombstone", record.Tombstone)
 
-	if err != nil {
-		internal.Logger.Debug("Read from sstable", "sstable", sstable.Path, "key", key, "value", record)
-	} else {
-		internal.Logger.Debug("Failed to read from sstable", "sstable", sstable.Path, "key", key, "value", record)
+	if record.Tombstone {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	return record.Value, nil
+}
+
+// memTables returns the active memtable followed by the queued immutable
+// ones, newest first. s.mu must be held.
+func (s *LSMTStorage) memTables() []MemTable {
+	memTables := []MemTable{s.memTable}
+	for _, imm := range slices.Backward(s.immutables) {
+		memTables = append(memTables, imm.memTable)
+	}
+	return memTables
+}
+
+// newIterator merges the memtables and the SSTables overlapping [start, end)
+// into a single iterator positioned at start, which yields the newest version
+// of each key as of seqNumber. An empty end leaves the range open. The
+// iterator may run past end and yields tombstones too. s.mu must be held for
+// as long as the iterator is used.
+func (s *LSMTStorage) newIterator(start, end string, seqNumber uint64) (RecordIterator, error) {
+	if s.closed {
+		return nil, ErrClosed
 	}
 
-	return record.Value, err
+	var sources []RecordIterator
+	for _, memTable := range s.memTables() {
+		sources = append(sources, NewMemTableIteratorFrom(memTable, start))
+	}
+
+	for _, sstable := range slices.Backward(s.ssTableManager.sstables[0]) {
+		if sstable.MaxKey < start || (end != "" && sstable.MinKey >= end) {
+			continue
+		}
+		iterator, err := s.ssTableManager.NewIteratorFrom(sstable, start)
+		if err != nil {
+			NewMergingIterator(sources...).Close()
+			return nil, err
+		}
+		sources = append(sources, iterator)
+	}
+
+	for level := 1; level <= s.ssTableManager.MaxLevel(); level++ {
+		sources = append(sources, s.ssTableManager.NewLevelIteratorFrom(level, start, end))
+	}
+
+	return NewVisibleIterator(NewMergingIterator(sources...), seqNumber), nil
 }
 
+// Iter yields every live key in ascending order. It holds a read lock while
+// iterating, so yield must not write to s.
 func (s *LSMTStorage) Iter(yield func(key string, value []byte) bool) {
-	var keys []string
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for el := range s.memTable.Iterator() {
-		keys = append(keys, el.Key)
-		if !yield(el.Key, el.Value) {
+	iterator, err := s.newIterator("", "", s.seqNumber)
+	if err != nil {
+		internal.Logger.Error("Failed to open iterator", "err", err)
+		return
+	}
+	defer iterator.Close()
+
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			internal.Logger.Error("Iteration failed", "err", err)
+			return
+		}
+		if record.Tombstone {
+			continue
+		}
+		if !yield(string(record.Key), record.Value) {
 			return
 		}
 	}
+}
 
-	for level := range s.ssTableManager.sstables {
-		for _, sstable := range s.ssTableManager.sstables[level] {
-			for _, key := range sstable.AllKeys() {
-				if !slices.Contains(keys, key) {
-					record, err := s.ssTableManager.Read(sstable, key)
-					if err == nil {
-						if !yield(key, record.Value) {
-							return
-						}
-					}
-				}
-			}
+// Scan returns the live keys in [start, end) in ascending order, at most
+// limit of them. An empty end leaves the range open and a limit of 0 or less
+// returns every key in range.
+func (s *LSMTStorage) Scan(start, end string, limit int) ([]KeyValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.scanAt(start, end, limit, s.seqNumber)
+}
+
+// scanAt is Scan as of seqNumber. s.mu must be held.
+func (s *LSMTStorage) scanAt(start, end string, limit int, seqNumber uint64) ([]KeyValue, error) {
+	iterator, err := s.newIterator(start, end, seqNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var results []KeyValue
+	for limit <= 0 || len(results) < limit {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if end != "" && string(record.Key) >= end {
+			break
+		}
+		if record.Tombstone {
+			continue
+		}
+		results = append(results, KeyValue{Key: string(record.Key), Value: record.Value})
+	}
+
+	return results, nil
+}
+
+// ScanPrefix returns the live keys starting with prefix in ascending order.
+func (s *LSMTStorage) ScanPrefix(prefix string) ([]KeyValue, error) {
+	return s.Scan(prefix, PrefixEnd(prefix), 0)
+}
+
+// PrefixEnd returns the smallest key above every key starting with prefix,
+// or "" when there is none.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for len(end) > 0 {
+		if end[len(end)-1] < 0xff {
+			end[len(end)-1]++
+			return string(end)
 		}
+		end = end[:len(end)-1]
 	}
+	return ""
 }
@@ -1,7 +1,13 @@
 package core
 
 import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ogioldat/ttrunksdb/tests"
 	"github.com/stretchr/testify/assert"
@@ -12,10 +18,20 @@ func TestMain(m *testing.M) {
 	m.Run()
 }
 
+// crash stops db without flushing its memtable, like a crash would, so that
+// reopening its directory recovers the memtable from the WAL.
+func crash(t *testing.T, db *LSMTStorage) {
+	db.mu.Lock()
+	db.closed = true
+	db.mu.Unlock()
+	assert.NoError(t, db.shutdown())
+}
+
 func TestDBRead(t *testing.T) {
 	tempDir := t.TempDir()
 
 	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(3))
+	t.Cleanup(func() { db.waitForFlushes() })
 
 	db.Write("a", []byte("data"))
 	db.Write("b", []byte("data"))
@@ -82,6 +98,18 @@ func TestDBReadNonExistentKey(t *testing.T) {
 	_, err := db.Read("non_existent_key")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "sstable not found")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Missing and deleted keys are told apart from failures the same way
+	snapshot := db.Snapshot()
+	_, err = snapshot.Read("non_existent_key")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	snapshot.Release()
+
+	txn := db.Begin()
+	_, err = txn.Get("non_existent_key")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	txn.Rollback()
 }
 
 func TestDBMemTableFlush(t *testing.T) {
@@ -90,6 +118,7 @@ func TestDBMemTableFlush(t *testing.T) {
 		WithOutDir(tempDir),
 		WithMemtableThreshold(3),
 	)
+	t.Cleanup(func() { db.waitForFlushes() })
 
 	db.Write("a", []byte("value_a"))
 	db.Write("b", []byte("value_b"))
@@ -106,6 +135,7 @@ func TestDBMemTableFlush(t *testing.T) {
 func TestDBReadFromSSTable(t *testing.T) {
 	tempDir := t.TempDir()
 	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+	t.Cleanup(func() { db.waitForFlushes() })
 
 	db.Write("a", []byte("value_a"))
 	db.Write("b", []byte("value_b"))
@@ -140,7 +170,617 @@ func TestDBConfigOptions(t *testing.T) {
 	assert.Equal(t, 100, db.config.memTableThreshold)
 	assert.Equal(t, tempDir, db.config.outputDir)
 
+	// Only the memtable size triggers flushes by default
 	db2 := NewLSMTStorage()
-	assert.Equal(t, 1000, db2.config.memTableThreshold)
+	assert.Zero(t, db2.config.memTableThreshold)
+	assert.Equal(t, DEFAULT_MEMTABLE_SIZE, db2.config.memTableSize)
 	// assert.Equal(t, DEFAULT_OUTPUT_DIR, db2.config.outputDir)
 }
+
+func TestDBRecoverFromWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+	crash(t, db)
+
+	recovered := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	assert.Equal(t, 2, recovered.memTable.Size())
+	assert.Equal(t, db.seqNumber, recovered.seqNumber)
+
+	value, err := recovered.Read("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_b"), value)
+
+	err = recovered.Write("c", []byte("value_c"))
+	assert.NoError(t, err)
+	crash(t, recovered)
+
+	reopened := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+	t.Cleanup(func() { reopened.Close() })
+	assert.Equal(t, 3, reopened.memTable.Size())
+}
+
+func TestDBReleasesWALAfterFlush(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+	db.Write("c", []byte("value_c"))
+	assert.NoError(t, db.waitForFlushes())
+
+	segments, err := db.wal.segments()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2}, segments)
+	crash(t, db)
+
+	// Only the write that was not flushed yet is replayed
+	recovered := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+	t.Cleanup(func() { recovered.Close() })
+	assert.Equal(t, 1, recovered.memTable.Size())
+	assert.Equal(t, "c", recovered.memTable.First().Key)
+}
+
+func TestDBDelete(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	db.Write("a", []byte("value_a"))
+	err := db.Delete("a")
+	assert.NoError(t, err)
+
+	_, err = db.Read("a")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "key not found")
+}
+
+func TestDBDeleteShadowsSSTable(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+	t.Cleanup(func() { db.waitForFlushes() })
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+
+	// The value of "a" now lives in an SSTable, the tombstone in the memtable
+	db.Delete("a")
+	_, err := db.Read("a")
+	assert.Error(t, err)
+
+	// Both are in SSTables, the newer one holds the tombstone
+	db.Write("c", []byte("value_c"))
+	assert.Equal(t, 0, db.memTable.Size())
+	_, err = db.Read("a")
+	assert.Error(t, err)
+
+	value, err := db.Read("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_b"), value)
+}
+
+func TestDBIterSkipsDeleted(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+	db.Delete("a")
+
+	var keys []string
+	for key := range db.Iter {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"b"}, keys)
+}
+
+func TestDBRecoverDelete(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	db.Write("a", []byte("value_a"))
+	db.Delete("a")
+	crash(t, db)
+
+	recovered := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+	t.Cleanup(func() { recovered.Close() })
+	_, err := recovered.Read("a")
+	assert.Error(t, err)
+}
+
+func TestDBReadAfterRestart(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+	db.Write("c", []byte("value_c"))
+	assert.NoError(t, db.Close())
+
+	restarted := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+	t.Cleanup(func() { restarted.Close() })
+
+	for key, expected := range map[string]string{"a": "value_a", "b": "value_b", "c": "value_c"} {
+		value, err := restarted.Read(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+
+	// Flushing after the restart must not overwrite the existing tables
+	restarted.Write("d", []byte("value_d"))
+	restarted.Write("e", []byte("value_e"))
+	assert.NoError(t, restarted.waitForFlushes())
+	assert.Len(t, restarted.ssTableManager.sstables[0], 3)
+
+	value, err := restarted.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_a"), value)
+}
+
+func TestDBSequenceNumberAfterRestart(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+
+	db.Write("a", []byte("value_a"))
+	db.Write("b", []byte("value_b"))
+	assert.NoError(t, db.Close())
+
+	// Every write is flushed, so the sequence number has to come from the MANIFEST
+	restarted := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+	t.Cleanup(func() { restarted.Close() })
+	assert.Equal(t, uint64(2), restarted.seqNumber)
+}
+
+// queueMemTable freezes the memtable like a write reaching the threshold does,
+// but without waking the background flush.
+func TestDBStalledWritersFreezeMemTableOnce(t *testing.T) {
+	db := NewLSMTStorage(WithOutDir(t.TempDir()), WithMemtableThreshold(2), WithMaxImmutableMemtables(1))
+
+	db.memTable.Append("a", []byte("value_a"))
+	queueMemTable(db)
+	assert.NoError(t, db.Write("b", []byte("value_b")))
+
+	// Both writers fill the same memtable and stall on the queue
+	var wg sync.WaitGroup
+	for _, key := range []string{"c", "d"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, db.Write(key, []byte("value_"+key)))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	db.flushRequests <- struct{}{}
+	wg.Wait()
+	assert.NoError(t, db.waitForFlushes())
+
+	// The writer that wakes up second finds a fresh memtable and leaves it be
+	assert.Len(t, db.ssTableManager.sstables[0], 2)
+	assert.Equal(t, "b", db.ssTableManager.sstables[0][1].MinKey)
+	assert.Equal(t, "d", db.ssTableManager.sstables[0][1].MaxKey)
+	assert.Zero(t, db.memTable.Size())
+}
+
+func TestDBCloseWithStalledWriter(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(1), WithMaxImmutableMemtables(1))
+
+	db.memTable.Append("a", []byte("value_a"))
+	queueMemTable(db)
+
+	written := make(chan error)
+	go func() {
+		written <- db.Write("b", []byte("value_b"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The stalled writer wakes up after Close started and leaves its memtable
+	// to it
+	db.flushRequests <- struct{}{}
+	assert.ErrorIs(t, <-written, ErrClosed)
+	assert.NoError(t, <-closed)
+
+	reopened := NewLSMTStorage(WithOutDir(tempDir))
+	t.Cleanup(func() { reopened.Close() })
+	assert.Zero(t, reopened.memTable.Size())
+	for key, expected := range map[string]string{"a": "value_a", "b": "value_b"} {
+		value, err := reopened.Read(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+}
+
+func queueMemTable(db *LSMTStorage) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.immutables = append(db.immutables, &immutableMemTable{memTable: db.memTable, seqNumber: db.seqNumber})
+	db.memTable = NewRBMemTable()
+}
+
+// testdata/sstable_v1.bin was flushed by the storage before SSTables had a
+// format version: text bloom filter and index, records without sequence
+// numbers.
+func TestDBReadsVersion1SSTable(t *testing.T) {
+	tempDir := t.TempDir()
+	fixture, err := os.ReadFile("testdata/sstable_v1.bin")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(path.Join(tempDir, "sstables", "level_0"), 0o755))
+	assert.NoError(t, os.WriteFile(path.Join(tempDir, "sstables", "level_0", "0001.bin"), fixture, 0o644))
+
+	db := newCompactionTestStorage(t, tempDir, WithMemtableThreshold(2), WithL0CompactionTrigger(2))
+	assert.Equal(t, uint32(1), db.ssTableManager.sstables[0][0].version)
+
+	expected := map[string]string{"apple": "red", "banana": "yellow", "cherry": "dark red", "date": "brown"}
+	check := func() {
+		for key, value := range expected {
+			actual, err := db.Read(key)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(value), actual)
+		}
+		results, err := db.Scan("", "", 0)
+		assert.NoError(t, err)
+		assert.Len(t, results, len(expected))
+	}
+	check()
+
+	// Newer writes shadow the records without sequence numbers, also once
+	// they are compacted into a table of the current version
+	db.Write("banana", []byte("green"))
+	db.Write("elderberry", []byte("purple"))
+	expected["banana"], expected["elderberry"] = "green", "purple"
+	check()
+
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+	assert.Empty(t, db.ssTableManager.sstables[0])
+	assert.Equal(t, SSTABLE_FORMAT_VERSION, db.ssTableManager.sstables[1][0].version)
+	check()
+}
+
+func TestDBReadFromImmutableMemTable(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	db.Write("a", []byte("old"))
+	db.Write("b", []byte("value_b"))
+	db.Write("c", []byte("value_c"))
+	queueMemTable(db)
+
+	db.Write("a", []byte("new"))
+	db.Delete("c")
+
+	value, err := db.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+
+	value, err = db.Read("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_b"), value)
+
+	_, err = db.Read("c")
+	assert.Error(t, err)
+
+	var keys []string
+	for key := range db.Iter {
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, keys)
+
+	db.flushRequests <- struct{}{}
+	assert.NoError(t, db.waitForFlushes())
+	assert.Len(t, db.ssTableManager.sstables[0], 1)
+
+	value, err = db.Read("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_b"), value)
+}
+
+func TestDBWriteStallsWhenFlushQueueIsFull(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(1), WithMaxImmutableMemtables(1))
+
+	db.memTable.Append("a", []byte("value_a"))
+	queueMemTable(db)
+
+	written := make(chan error)
+	go func() {
+		written <- db.Write("b", []byte("value_b"))
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write did not wait for the flush queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	db.flushRequests <- struct{}{}
+	assert.NoError(t, <-written)
+	assert.NoError(t, db.waitForFlushes())
+
+	assert.Len(t, db.ssTableManager.sstables[0], 2)
+	for key, expected := range map[string]string{"a": "value_a", "b": "value_b"} {
+		value, err := db.Read(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+}
+
+func TestDBIterMergesAllSources(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(3), WithL0CompactionTrigger(2))
+	t.Cleanup(func() { db.waitForFlushes() })
+
+	// Two flushes, compacted into level 1
+	db.Write("b", []byte("b1"))
+	db.Write("d", []byte("d1"))
+	db.Write("f", []byte("f1"))
+	db.Write("a", []byte("a1"))
+	db.Write("e", []byte("e1"))
+	db.Write("g", []byte("g1"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	// A level 0 table
+	db.Write("d", []byte("d2"))
+	db.Delete("e")
+	db.Write("c", []byte("c2"))
+	assert.NoError(t, db.waitForFlushes())
+
+	// An immutable memtable and the active one
+	db.Write("a", []byte("a3"))
+	db.Delete("c")
+	queueMemTable(db)
+	db.Write("h", []byte("h4"))
+	db.Write("a", []byte("a4"))
+
+	assert.Len(t, db.ssTableManager.sstables[0], 1)
+	assert.NotEmpty(t, db.ssTableManager.sstables[1])
+
+	var keys, values []string
+	for key, value := range db.Iter {
+		keys = append(keys, key)
+		values = append(values, string(value))
+	}
+	assert.Equal(t, []string{"a", "b", "d", "f", "g", "h"}, keys)
+	assert.Equal(t, []string{"a4", "b1", "d2", "f1", "g1", "h4"}, values)
+
+	// Let the cleanup flush the queued memtable
+	db.flushRequests <- struct{}{}
+}
+
+func TestDBScan(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(3), WithL0CompactionTrigger(2))
+	t.Cleanup(func() { db.waitForFlushes() })
+
+	for _, key := range []string{"a", "c", "e", "g", "i", "k"} {
+		db.Write(key, []byte("old_"+key))
+	}
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	db.Write("b", []byte("value_b"))
+	db.Write("e", []byte("new_e"))
+	db.Delete("g")
+
+	keys := func(results []KeyValue) []string {
+		var keys []string
+		for _, result := range results {
+			keys = append(keys, result.Key)
+		}
+		return keys
+	}
+
+	results, err := db.Scan("b", "i", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "e"}, keys(results))
+	assert.Equal(t, []byte("new_e"), results[2].Value)
+
+	results, err = db.Scan("d", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e", "i", "k"}, keys(results))
+
+	results, err = db.Scan("", "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys(results))
+
+	results, err = db.Scan("x", "z", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestDBScanPrefix(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(3))
+	t.Cleanup(func() { db.waitForFlushes() })
+
+	db.Write("2024-01:a", []byte("1"))
+	db.Write("2024-02:a", []byte("2"))
+	db.Write("2024-02:b", []byte("3"))
+	db.Write("2024-03:a", []byte("4"))
+	db.Write("2024-02", []byte("5"))
+
+	results, err := db.ScanPrefix("2024-02")
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyValue{
+		{Key: "2024-02", Value: []byte("5")},
+		{Key: "2024-02:a", Value: []byte("2")},
+		{Key: "2024-02:b", Value: []byte("3")},
+	}, results)
+
+	assert.Equal(t, "2024-03", PrefixEnd("2024-02"))
+	assert.Equal(t, "b", PrefixEnd("a\xff\xff"))
+	assert.Equal(t, "", PrefixEnd("\xff"))
+}
+
+func TestDBClose(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+
+	db.Write("a", []byte("value_a"))
+	db.Delete("b")
+	assert.NoError(t, db.Close())
+
+	assert.ErrorIs(t, db.Write("c", []byte("value_c")), ErrClosed)
+	_, err := db.Read("a")
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = db.Scan("", "", 0)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, db.Compact(), ErrClosed)
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+
+	// The memtable was flushed, so nothing is left to replay
+	reopened := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(10))
+	assert.Equal(t, 0, reopened.memTable.Size())
+	assert.Equal(t, uint64(2), reopened.seqNumber)
+
+	value, err := reopened.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_a"), value)
+	assert.NoError(t, reopened.Close())
+}
+
+func TestDBOverwritesDoNotFillMemTable(t *testing.T) {
+	for _, memTableType := range []MemTableType{MemTableRBTree, MemTableSkipList} {
+		t.Run(memTableType.String(), func(t *testing.T) {
+			db := NewLSMTStorage(WithOutDir(t.TempDir()), WithMemtableThreshold(3), WithMemTableType(memTableType))
+			t.Cleanup(func() { db.Close() })
+
+			for i := range 10 {
+				assert.NoError(t, db.Write("key", []byte(fmt.Sprintf("value%d", i))))
+			}
+			assert.NoError(t, db.waitForFlushes())
+
+			stats := db.Stats()
+			assert.Equal(t, 1, stats.MemTableEntries)
+			assert.Equal(t, memTableEntrySize("key", []byte("value9")), stats.MemTableBytes)
+			assert.Zero(t, stats.Levels[0].Tables)
+
+			// Versions a snapshot reads still count
+			snapshot := db.Snapshot()
+			defer snapshot.Release()
+			assert.NoError(t, db.Write("key", []byte("value10")))
+			assert.Equal(t, 2, db.Stats().MemTableEntries)
+		})
+	}
+}
+
+func TestDBMemTableSizeThreshold(t *testing.T) {
+	tempDir := t.TempDir()
+	entrySize := memTableEntrySize("key0", make([]byte, 100))
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableSize(3*entrySize))
+	t.Cleanup(func() { db.waitForFlushes() })
+
+	value := make([]byte, 100)
+	for i := range 2 {
+		assert.NoError(t, db.Write(fmt.Sprintf("key%d", i), value))
+	}
+	stats := db.Stats()
+	assert.Equal(t, 2, stats.MemTableEntries)
+	assert.Equal(t, 2*entrySize, stats.MemTableBytes)
+
+	// Small values fill the memtable up much slower
+	db.Write("a", []byte("1"))
+	assert.Equal(t, 3, db.Stats().MemTableEntries)
+
+	assert.NoError(t, db.Write("key2", value))
+	assert.NoError(t, db.waitForFlushes())
+
+	stats = db.Stats()
+	assert.Equal(t, uint64(4), stats.SeqNumber)
+	assert.Equal(t, 0, stats.MemTableEntries)
+	assert.Equal(t, 0, stats.ImmutableMemTables)
+	assert.Equal(t, 1, stats.Levels[0].Tables)
+	assert.Positive(t, stats.Levels[0].Bytes)
+
+	// Without an entry threshold, many small entries stay in a large memtable
+	large := NewLSMTStorage(WithOutDir(t.TempDir()), WithMemtableSize(64*MB), WithWALSyncMode(WALSyncNone))
+	t.Cleanup(func() { large.Close() })
+	for i := range 5000 {
+		assert.NoError(t, large.Write(fmt.Sprintf("key%d", i), []byte("1")))
+	}
+	stats = large.Stats()
+	assert.Equal(t, 5000, stats.MemTableEntries)
+	assert.Equal(t, 0, stats.ImmutableMemTables)
+	assert.Zero(t, stats.Levels[0].Tables)
+}
+
+func TestDBSkipListMemTable(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(3), WithMemTableType(MemTableSkipList))
+	assert.IsType(t, &SkipListMemTable{}, db.memTable)
+
+	db.Write("a", []byte("value_a"))
+	snapshot := db.Snapshot()
+	db.Write("a", []byte("value_a2"))
+	db.Delete("b")
+	db.Write("c", []byte("value_c"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.IsType(t, &SkipListMemTable{}, db.memTable)
+
+	value, err := db.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_a2"), value)
+	value, err = snapshot.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value_a"), value)
+	snapshot.Release()
+
+	db.Write("d", []byte("value_d"))
+	assert.NoError(t, db.Close())
+
+	reopened := NewLSMTStorage(WithOutDir(tempDir), WithMemTableType(MemTableSkipList))
+	records, err := reopened.Scan("", "", 0)
+	assert.NoError(t, err)
+	var keys []string
+	for _, record := range records {
+		keys = append(keys, string(record.Key))
+	}
+	assert.Equal(t, []string{"a", "c", "d"}, keys)
+	assert.NoError(t, reopened.Close())
+}
+
+// BenchmarkDBConcurrent compares the memtables under concurrent clients.
+// Writes hold the storage lock exclusively whatever the memtable, so they are
+// serialized either way; the memtable only changes the work done under it.
+func BenchmarkDBConcurrent(b *testing.B) {
+	value := []byte("value")
+
+	for _, memTableType := range []MemTableType{MemTableRBTree, MemTableSkipList} {
+		// One in writeEvery operations is a write, the rest are reads
+		for _, writeEvery := range []uint64{1, 10} {
+			b.Run(fmt.Sprintf("%s/write_every_%d", memTableType, writeEvery), func(b *testing.B) {
+				db := NewLSMTStorage(WithOutDir(b.TempDir()), WithMemTableType(memTableType), WithWALSyncMode(WALSyncNone))
+				for i := range 10000 {
+					db.Write(fmt.Sprintf("key_%d", i), value)
+				}
+
+				var seq atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n := seq.Add(1)
+						key := fmt.Sprintf("key_%d", n%10000)
+						if n%writeEvery == 0 {
+							db.Write(key, value)
+						} else {
+							db.Read(key)
+						}
+					}
+				})
+				b.StopTimer()
+				db.Close()
+			})
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ogioldat/ttrunksdb/algo"
+)
+
+// RecordIterator yields records in ascending key order, the versions of a key
+// newest first. Next returns io.EOF once the iterator is exhausted.
+type RecordIterator interface {
+	Next() (*DBRecord, error)
+	Close() error
+}
+
+// sstableIterator reads the records of an SSTable in the order they were
+// written, which is sorted by key.
+type sstableIterator struct {
+	file         *os.File
+	reader       *bufio.Reader
+	deserializer SSTableDeserializer
+	version      uint32
+	start        string
+}
+
+func (m *SSTableManager) NewIterator(s *SSTable) (RecordIterator, error) {
+	return m.NewIteratorFrom(s, "")
+}
+
+// NewIteratorFrom returns an iterator over the records of s with keys from
+// start on. It seeks through the index to the closest record before start.
+func (m *SSTableManager) NewIteratorFrom(s *SSTable, start string) (RecordIterator, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(int64(s.dataOffset)+int64(s.seek(start)), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &sstableIterator{file: file, reader: bufio.NewReader(file), deserializer: m.deserializer, version: s.version, start: start}, nil
+}
+
+func (it *sstableIterator) Next() (*DBRecord, error) {
+	for {
+		record, err := it.deserializer.DeserializeRecord(it.reader, it.version)
+		if err != nil {
+			return nil, err
+		}
+		if string(record.Key) >= it.start {
+			return record, nil
+		}
+	}
+}
+
+func (it *sstableIterator) Close() error {
+	return it.file.Close()
+}
+
+// memTableIterator reads the records of a memtable in key order, tombstones
+// and older versions included.
+type memTableIterator struct {
+	cursor MemTableCursor
+	older  *algo.Node // Next version of the key last read
+}
+
+func NewMemTableIterator(memTable MemTable) RecordIterator {
+	return NewMemTableIteratorFrom(memTable, "")
+}
+
+func NewMemTableIteratorFrom(memTable MemTable, start string) RecordIterator {
+	cursor := memTable.Cursor()
+	cursor.Seek(start)
+	return &memTableIterator{cursor: cursor}
+}
+
+func (it *memTableIterator) Next() (*DBRecord, error) {
+	node := it.older
+	if node == nil {
+		if !it.cursor.Valid() {
+			return nil, io.EOF
+		}
+		node = it.cursor.Node()
+		it.cursor.Next()
+	}
+	it.older = node.Older
+
+	return &DBRecord{
+		Key:       DBRecordKey(node.Key),
+		Value:     node.Value,
+		Timestamp: DBRecordTimestamp(node.Metadata.Timestamp.Unix()),
+		Tombstone: DBRecordTombstone(node.Metadata.Tombstone),
+		SeqNumber: node.Metadata.SeqNumber,
+	}, nil
+}
+
+func (it *memTableIterator) Close() error {
+	return nil
+}
+
+// levelIterator reads the tables of a level below 0 one after another. Their
+// key ranges are disjoint and sorted, so the records come out in key order.
+// Each table is only opened once the previous one is exhausted.
+type levelIterator struct {
+	manager  *SSTableManager
+	sstables []*SSTable
+	current  RecordIterator
+	start    string
+}
+
+func (m *SSTableManager) NewLevelIterator(level int) RecordIterator {
+	return m.NewLevelIteratorFrom(level, "", "")
+}
+
+// NewLevelIteratorFrom returns an iterator over the records of level with
+// keys from start on. Only the tables overlapping [start, end) are read; an
+// empty end leaves the range open.
+func (m *SSTableManager) NewLevelIteratorFrom(level int, start, end string) RecordIterator {
+	sstables := m.sstables[level]
+	first := sort.Search(len(sstables), func(i int) bool {
+		return sstables[i].MaxKey >= start
+	})
+	last := len(sstables)
+	if end != "" {
+		last = sort.Search(len(sstables), func(i int) bool {
+			return sstables[i].MinKey >= end
+		})
+	}
+
+	return &levelIterator{manager: m, sstables: sstables[first:max(first, last)], start: start}
+}
+
+func (it *levelIterator) Next() (*DBRecord, error) {
+	for {
+		if it.current == nil {
+			if len(it.sstables) == 0 {
+				return nil, io.EOF
+			}
+			// Only the first table can hold keys before start
+			current, err := it.manager.NewIteratorFrom(it.sstables[0], it.start)
+			if err != nil {
+				return nil, err
+			}
+			it.current = current
+			it.sstables = it.sstables[1:]
+		}
+
+		record, err := it.current.Next()
+		if err != io.EOF {
+			return record, err
+		}
+		if err := it.current.Close(); err != nil {
+			return nil, err
+		}
+		it.current = nil
+	}
+}
+
+func (it *levelIterator) Close() error {
+	if it.current == nil {
+		return nil
+	}
+	return it.current.Close()
+}
+
+type mergingIteratorItem struct {
+	record *DBRecord
+	source int
+}
+
+// mergingIteratorHeap orders records by key, records of the same key newest
+// first, and records of the same version by the priority of their source.
+type mergingIteratorHeap []mergingIteratorItem
+
+func (h mergingIteratorHeap) Len() int { return len(h) }
+
+func (h mergingIteratorHeap) Less(i, j int) bool {
+	if h[i].record.Key != h[j].record.Key {
+		return h[i].record.Key < h[j].record.Key
+	}
+	if h[i].record.SeqNumber != h[j].record.SeqNumber {
+		return h[i].record.SeqNumber > h[j].record.SeqNumber
+	}
+	return h[i].source < h[j].source
+}
+
+func (h mergingIteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergingIteratorHeap) Push(x any) { *h = append(*h, x.(mergingIteratorItem)) }
+
+func (h *mergingIteratorHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mergingIterator merges sorted iterators into one, yielding every version of
+// every key. Sources are ordered newest first, which decides between records
+// that carry the same sequence number, e.g. ones written before sequence
+// numbers were stored.
+type mergingIterator struct {
+	sources []RecordIterator
+	heap    mergingIteratorHeap
+	started bool
+}
+
+func NewMergingIterator(sources ...RecordIterator) RecordIterator {
+	return &mergingIterator{sources: sources}
+}
+
+func (it *mergingIterator) advance(source int) error {
+	record, err := it.sources[source].Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(&it.heap, mergingIteratorItem{record: record, source: source})
+	return nil
+}
+
+func (it *mergingIterator) Next() (*DBRecord, error) {
+	if !it.started {
+		it.started = true
+		for source := range it.sources {
+			if err := it.advance(source); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if it.heap.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	item := heap.Pop(&it.heap).(mergingIteratorItem)
+	if err := it.advance(item.source); err != nil {
+		return nil, err
+	}
+
+	return item.record, nil
+}
+
+func (it *mergingIterator) Close() error {
+	var firstErr error
+	for _, source := range it.sources {
+		if err := source.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// visibleIterator yields the newest version of every key written at or before
+// seqNumber, tombstones included.
+type visibleIterator struct {
+	source    RecordIterator
+	seqNumber uint64
+	last      *DBRecord // Last record yielded
+}
+
+func NewVisibleIterator(source RecordIterator, seqNumber uint64) RecordIterator {
+	return &visibleIterator{source: source, seqNumber: seqNumber}
+}
+
+func (it *visibleIterator) Next() (*DBRecord, error) {
+	for {
+		record, err := it.source.Next()
+		if err != nil {
+			return nil, err
+		}
+		if record.SeqNumber > it.seqNumber {
+			continue
+		}
+		// Older versions of the key last yielded are shadowed by it
+		if it.last != nil && it.last.Key == record.Key {
+			continue
+		}
+		it.last = record
+		return record, nil
+	}
+}
+
+func (it *visibleIterator) Close() error {
+	return it.source.Close()
+}
+
+// collectRecords reads it to the end and closes it.
+func collectRecords(it RecordIterator) ([]DBRecord, error) {
+	defer it.Close()
+
+	var records []DBRecord
+	for {
+		record, err := it.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+}
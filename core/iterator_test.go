@@ -0,0 +1,132 @@
+package core
+
+import (
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sliceIterator struct {
+	records []DBRecord
+}
+
+func (it *sliceIterator) Next() (*DBRecord, error) {
+	if len(it.records) == 0 {
+		return nil, io.EOF
+	}
+	record := it.records[0]
+	it.records = it.records[1:]
+	return &record, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+func collect(t *testing.T, it RecordIterator) []DBRecord {
+	var records []DBRecord
+	for {
+		record, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		records = append(records, *record)
+	}
+	assert.NoError(t, it.Close())
+	return records
+}
+
+func TestMergingIteratorNewestWins(t *testing.T) {
+	newest := &sliceIterator{records: []DBRecord{
+		{Key: "b", Value: DBRecordValue("new")},
+		{Key: "d", Tombstone: true},
+	}}
+	oldest := &sliceIterator{records: []DBRecord{
+		{Key: "a", Value: DBRecordValue("1")},
+		{Key: "b", Value: DBRecordValue("old")},
+		{Key: "d", Value: DBRecordValue("deleted")},
+		{Key: "e", Value: DBRecordValue("5")},
+	}}
+
+	records := collect(t, NewVisibleIterator(NewMergingIterator(newest, &sliceIterator{}, oldest), math.MaxUint64))
+
+	assert.Equal(t, []DBRecord{
+		{Key: "a", Value: DBRecordValue("1")},
+		{Key: "b", Value: DBRecordValue("new")},
+		{Key: "d", Tombstone: true},
+		{Key: "e", Value: DBRecordValue("5")},
+	}, records)
+}
+
+func TestMergingIteratorOrdersVersions(t *testing.T) {
+	sources := func() []RecordIterator {
+		memTable := &sliceIterator{records: []DBRecord{
+			{Key: "a", Value: DBRecordValue("a4"), SeqNumber: 4},
+			{Key: "a", Value: DBRecordValue("a2"), SeqNumber: 2},
+		}}
+		sstable := &sliceIterator{records: []DBRecord{
+			{Key: "a", Value: DBRecordValue("a3"), SeqNumber: 3},
+			{Key: "a", Value: DBRecordValue("a1"), SeqNumber: 1},
+			{Key: "b", Tombstone: true, SeqNumber: 5},
+		}}
+		return []RecordIterator{memTable, sstable}
+	}
+
+	var seqNumbers []uint64
+	for _, record := range collect(t, NewMergingIterator(sources()...)) {
+		seqNumbers = append(seqNumbers, record.SeqNumber)
+	}
+	assert.Equal(t, []uint64{4, 3, 2, 1, 5}, seqNumbers)
+
+	// As of sequence 3, a4 and the tombstone of b are not written yet
+	records := collect(t, NewVisibleIterator(NewMergingIterator(sources()...), 3))
+	assert.Equal(t, []DBRecord{{Key: "a", Value: DBRecordValue("a3"), SeqNumber: 3}}, records)
+}
+
+func TestSSTableIterator(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000}
+	manager := NewSSTableManager(cfg)
+
+	memtable, _ := NewFromKVPairs("c:3,a:1,b:2")
+	sstable := manager.AddSSTable(cfg)
+	assert.NoError(t, manager.Flush(sstable, memtable))
+
+	iterator, err := manager.NewIterator(sstable)
+	assert.NoError(t, err)
+
+	var keys []DBRecordKey
+	for _, record := range collect(t, iterator) {
+		keys = append(keys, record.Key)
+	}
+	assert.Equal(t, []DBRecordKey{"a", "b", "c"}, keys)
+}
+
+func TestSSTableIteratorFrom(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000}
+	manager := NewSSTableManager(cfg)
+
+	memtable, _ := NewFromKVPairs("a:1,b:2,d:4,e:5")
+	sstable := manager.AddSSTable(cfg)
+	assert.NoError(t, manager.Flush(sstable, memtable))
+
+	testCases := map[string][]DBRecordKey{
+		"":  {"a", "b", "d", "e"},
+		"b": {"b", "d", "e"},
+		"c": {"d", "e"},
+		"f": nil,
+	}
+
+	for start, expected := range testCases {
+		iterator, err := manager.NewIteratorFrom(sstable, start)
+		assert.NoError(t, err)
+
+		var keys []DBRecordKey
+		for _, record := range collect(t, iterator) {
+			keys = append(keys, record.Key)
+		}
+		assert.Equal(t, expected, keys, "start %q", start)
+	}
+}
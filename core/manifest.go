@@ -0,0 +1,471 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ogioldat/ttrunksdb/internal"
+)
+
+const MANIFEST_CURRENT_FILE = "CURRENT"
+const MANIFEST_FILE_PREFIX = "MANIFEST-"
+
+type versionEditTag uint8
+
+const (
+	versionEditAddTable versionEditTag = iota + 1
+	versionEditRemoveTable
+	versionEditSetLevel
+	versionEditLastSequence
+	versionEditLogNumber
+	versionEditNextFileNumber
+)
+
+// TableMetadata describes a live SSTable in the MANIFEST.
+type TableMetadata struct {
+	Level     int
+	Name      string
+	SeqNumber int
+	Size      int64
+	MinKey    string
+	MaxKey    string
+}
+
+// TableMove changes the level of a table without rewriting it.
+type TableMove struct {
+	Name      string
+	FromLevel int
+	ToLevel   int
+}
+
+// VersionEdit is an atomic change to the set of live SSTables. Zero
+// sequence and file numbers mean the edit leaves them unchanged.
+type VersionEdit struct {
+	AddedTables    []TableMetadata
+	RemovedTables  []TableMetadata
+	MovedTables    []TableMove
+	LastSequence   uint64
+	LogNumber      uint64 // WAL segments below this one are no longer needed
+	NextFileNumber int
+}
+
+// VersionSet is the state described by a MANIFEST: all of its version edits
+// applied in order.
+type VersionSet struct {
+	Tables         map[string]TableMetadata
+	LastSequence   uint64
+	LogNumber      uint64
+	NextFileNumber int
+}
+
+func NewVersionSet() *VersionSet {
+	return &VersionSet{Tables: make(map[string]TableMetadata)}
+}
+
+func (v *VersionSet) Apply(edit *VersionEdit) {
+	for _, table := range edit.RemovedTables {
+		delete(v.Tables, table.Name)
+	}
+	for _, table := range edit.AddedTables {
+		v.Tables[table.Name] = table
+	}
+	for _, move := range edit.MovedTables {
+		if table, ok := v.Tables[move.Name]; ok {
+			table.Level = move.ToLevel
+			v.Tables[move.Name] = table
+		}
+	}
+	v.LastSequence = max(v.LastSequence, edit.LastSequence)
+	v.LogNumber = max(v.LogNumber, edit.LogNumber)
+	v.NextFileNumber = max(v.NextFileNumber, edit.NextFileNumber)
+}
+
+// Snapshot returns a single edit that recreates the version set.
+func (v *VersionSet) Snapshot() *VersionEdit {
+	edit := &VersionEdit{
+		LastSequence:   v.LastSequence,
+		LogNumber:      v.LogNumber,
+		NextFileNumber: v.NextFileNumber,
+	}
+	for _, table := range v.Tables {
+		edit.AddedTables = append(edit.AddedTables, table)
+	}
+	return edit
+}
+
+func writeManifestString(buf *bytes.Buffer, s string) error {
+	if err := binary.Write(buf, BYTES_ORDER, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := buf.WriteString(s)
+	return err
+}
+
+func readManifestString(reader io.Reader) (string, error) {
+	var size uint32
+	if err := binary.Read(reader, BYTES_ORDER, &size); err != nil {
+		return "", err
+	}
+	s := make([]byte, size)
+	if _, err := io.ReadFull(reader, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func writeTableMetadata(buf *bytes.Buffer, table TableMetadata) error {
+	if err := binary.Write(buf, BYTES_ORDER, uint32(table.Level)); err != nil {
+		return err
+	}
+	if err := writeManifestString(buf, table.Name); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, BYTES_ORDER, uint64(table.SeqNumber)); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, BYTES_ORDER, table.Size); err != nil {
+		return err
+	}
+	if err := writeManifestString(buf, table.MinKey); err != nil {
+		return err
+	}
+	return writeManifestString(buf, table.MaxKey)
+}
+
+func readTableMetadata(reader io.Reader) (TableMetadata, error) {
+	var table TableMetadata
+	var level uint32
+	var seqNumber uint64
+	var err error
+
+	if err = binary.Read(reader, BYTES_ORDER, &level); err != nil {
+		return table, err
+	}
+	table.Level = int(level)
+	if table.Name, err = readManifestString(reader); err != nil {
+		return table, err
+	}
+	if err = binary.Read(reader, BYTES_ORDER, &seqNumber); err != nil {
+		return table, err
+	}
+	table.SeqNumber = int(seqNumber)
+	if err = binary.Read(reader, BYTES_ORDER, &table.Size); err != nil {
+		return table, err
+	}
+	if table.MinKey, err = readManifestString(reader); err != nil {
+		return table, err
+	}
+	table.MaxKey, err = readManifestString(reader)
+	return table, err
+}
+
+// MarshalBinary encodes the edit as a list of tagged fields.
+func (e *VersionEdit) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	for _, table := range e.RemovedTables {
+		if err := buf.WriteByte(byte(versionEditRemoveTable)); err != nil {
+			return nil, err
+		}
+		if err := writeTableMetadata(buf, table); err != nil {
+			return nil, err
+		}
+	}
+	for _, table := range e.AddedTables {
+		if err := buf.WriteByte(byte(versionEditAddTable)); err != nil {
+			return nil, err
+		}
+		if err := writeTableMetadata(buf, table); err != nil {
+			return nil, err
+		}
+	}
+	for _, move := range e.MovedTables {
+		if err := buf.WriteByte(byte(versionEditSetLevel)); err != nil {
+			return nil, err
+		}
+		if err := writeManifestString(buf, move.Name); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, BYTES_ORDER, uint32(move.FromLevel)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, BYTES_ORDER, uint32(move.ToLevel)); err != nil {
+			return nil, err
+		}
+	}
+	if e.LastSequence != 0 {
+		if err := buf.WriteByte(byte(versionEditLastSequence)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, BYTES_ORDER, e.LastSequence); err != nil {
+			return nil, err
+		}
+	}
+	if e.LogNumber != 0 {
+		if err := buf.WriteByte(byte(versionEditLogNumber)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, BYTES_ORDER, e.LogNumber); err != nil {
+			return nil, err
+		}
+	}
+	if e.NextFileNumber != 0 {
+		if err := buf.WriteByte(byte(versionEditNextFileNumber)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, BYTES_ORDER, uint64(e.NextFileNumber)); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *VersionEdit) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+
+	for reader.Len() > 0 {
+		tag, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch versionEditTag(tag) {
+		case versionEditAddTable:
+			table, err := readTableMetadata(reader)
+			if err != nil {
+				return err
+			}
+			e.AddedTables = append(e.AddedTables, table)
+		case versionEditRemoveTable:
+			table, err := readTableMetadata(reader)
+			if err != nil {
+				return err
+			}
+			e.RemovedTables = append(e.RemovedTables, table)
+		case versionEditSetLevel:
+			var move TableMove
+			var fromLevel, toLevel uint32
+			if move.Name, err = readManifestString(reader); err != nil {
+				return err
+			}
+			if err := binary.Read(reader, BYTES_ORDER, &fromLevel); err != nil {
+				return err
+			}
+			if err := binary.Read(reader, BYTES_ORDER, &toLevel); err != nil {
+				return err
+			}
+			move.FromLevel = int(fromLevel)
+			move.ToLevel = int(toLevel)
+			e.MovedTables = append(e.MovedTables, move)
+		case versionEditLastSequence:
+			if err := binary.Read(reader, BYTES_ORDER, &e.LastSequence); err != nil {
+				return err
+			}
+		case versionEditLogNumber:
+			if err := binary.Read(reader, BYTES_ORDER, &e.LogNumber); err != nil {
+				return err
+			}
+		case versionEditNextFileNumber:
+			var next uint64
+			if err := binary.Read(reader, BYTES_ORDER, &next); err != nil {
+				return err
+			}
+			e.NextFileNumber = int(next)
+		default:
+			return fmt.Errorf("unknown version edit tag: %d", tag)
+		}
+	}
+
+	return nil
+}
+
+// Manifest is an append-only log of version edits. The CURRENT file names
+// the manifest in use and is only ever replaced through an atomic rename.
+type Manifest struct {
+	dir    string
+	number uint64
+	file   logFile
+	size   int64 // Bytes of whole edits
+	err    error // Set once the manifest holds a partial edit
+}
+
+// ErrManifestFailed is returned by every Append once a failed append to the
+// MANIFEST could not be undone.
+var ErrManifestFailed = errors.New("MANIFEST unusable after failed append")
+
+func manifestName(number uint64) string {
+	return fmt.Sprintf("%s%06d", MANIFEST_FILE_PREFIX, number)
+}
+
+// ReadManifest replays the manifest named by CURRENT in dir. It returns a
+// nil version set when there is no manifest yet. A corrupt final edit, left
+// by a crash while it was being appended, is ignored. A corrupt edit followed
+// by more fails the replay: the edits after it may have added tables, and
+// released the WAL segments holding their records.
+func ReadManifest(dir string) (*VersionSet, uint64, error) {
+	current, err := os.ReadFile(path.Join(dir, MANIFEST_CURRENT_FILE))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	name := strings.TrimSpace(string(current))
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, MANIFEST_FILE_PREFIX), 10, 64)
+	if err != nil || !strings.HasPrefix(name, MANIFEST_FILE_PREFIX) {
+		return nil, 0, fmt.Errorf("invalid CURRENT file: %q", name)
+	}
+
+	file, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	versions := NewVersionSet()
+	reader := frameReader{reader: bufio.NewReader(file)}
+
+	for {
+		err := reader.next(func(payload []byte) error {
+			edit := &VersionEdit{}
+			if err := edit.UnmarshalBinary(payload); err != nil {
+				return err
+			}
+			versions.Apply(edit)
+			return nil
+		})
+		if err == io.EOF {
+			break
+		}
+
+		var corruption *WALCorruptionError
+		if errors.As(err, &corruption) {
+			if reader.end < info.Size() {
+				return nil, 0, fmt.Errorf("MANIFEST %s: %w", name, err)
+			}
+			internal.Logger.Warn("Discarding MANIFEST tail", "manifest", name, "offset", corruption.Offset, "reason", corruption.Reason)
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return versions, number, nil
+}
+
+// CreateManifest starts a new manifest holding a snapshot of versions and
+// points CURRENT to it. Older manifests are removed afterwards.
+func CreateManifest(dir string, number uint64, versions *VersionSet) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	name := manifestName(number)
+	file, err := os.OpenFile(path.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{dir: dir, number: number, file: file}
+	if err := manifest.Append(versions.Snapshot()); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tmpPath := path.Join(dir, MANIFEST_CURRENT_FILE+".tmp")
+	if err := writeFileSync(tmpPath, []byte(name+"\n")); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path.Join(dir, MANIFEST_CURRENT_FILE)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), MANIFEST_FILE_PREFIX) && entry.Name() != name {
+			if err := os.Remove(path.Join(dir, entry.Name())); err != nil {
+				internal.Logger.Warn("Failed to remove old MANIFEST", "manifest", entry.Name(), "err", err)
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// Append durably logs an edit. The edit only takes effect once Append returns.
+// A failed append is cut off the manifest, so that the edits appended after
+// it are still read back.
+func (m *Manifest) Append(edit *VersionEdit) error {
+	payload, err := edit.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	frame, err := encodeFrame(payload)
+	if err != nil {
+		return err
+	}
+
+	if m.err != nil {
+		return m.err
+	}
+	if _, err := m.file.Write(frame); err != nil {
+		return m.undo(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return m.undo(err)
+	}
+	m.size += int64(len(frame))
+	return nil
+}
+
+// undo truncates the manifest back to its last whole edit after err.
+func (m *Manifest) undo(err error) error {
+	if truncateErr := m.file.Truncate(m.size); truncateErr != nil {
+		m.err = fmt.Errorf("%w: %w", ErrManifestFailed, errors.Join(err, truncateErr))
+		return m.err
+	}
+	return err
+}
+
+func (m *Manifest) Close() error {
+	return m.file.Close()
+}
+
+func writeFileSync(filePath string, data []byte) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
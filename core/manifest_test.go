@@ -0,0 +1,156 @@
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionEditRoundTrip(t *testing.T) {
+	edit := &VersionEdit{
+		AddedTables: []TableMetadata{
+			{Level: 1, Name: "0003", SeqNumber: 3, Size: 512, MinKey: "a", MaxKey: "m"},
+		},
+		RemovedTables: []TableMetadata{
+			{Level: 0, Name: "0001", SeqNumber: 1, Size: 128, MinKey: "a", MaxKey: "f"},
+		},
+		MovedTables:    []TableMove{{Name: "0002", FromLevel: 0, ToLevel: 1}},
+		LastSequence:   42,
+		LogNumber:      7,
+		NextFileNumber: 4,
+	}
+
+	encoded, err := edit.MarshalBinary()
+	assert.NoError(t, err)
+
+	decoded := &VersionEdit{}
+	assert.NoError(t, decoded.UnmarshalBinary(encoded))
+	assert.Equal(t, edit, decoded)
+}
+
+func TestVersionSetApply(t *testing.T) {
+	versions := NewVersionSet()
+	versions.Apply(&VersionEdit{
+		AddedTables:  []TableMetadata{{Name: "0001"}, {Name: "0002"}},
+		LastSequence: 10,
+		LogNumber:    2,
+	})
+	versions.Apply(&VersionEdit{
+		RemovedTables: []TableMetadata{{Name: "0001"}},
+		MovedTables:   []TableMove{{Name: "0002", FromLevel: 0, ToLevel: 1}},
+		LastSequence:  5,
+	})
+
+	assert.Equal(t, map[string]TableMetadata{"0002": {Name: "0002", Level: 1}}, versions.Tables)
+	assert.Equal(t, uint64(10), versions.LastSequence)
+	assert.Equal(t, uint64(2), versions.LogNumber)
+}
+
+func TestManifestRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	versions, _, err := ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Nil(t, versions)
+
+	manifest, err := CreateManifest(dir, 1, NewVersionSet())
+	assert.NoError(t, err)
+	assert.NoError(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0001"}}, LastSequence: 3}))
+	assert.NoError(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0002"}}, LastSequence: 6}))
+	assert.NoError(t, manifest.Close())
+
+	versions, number, err := ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), number)
+	assert.Len(t, versions.Tables, 2)
+	assert.Equal(t, uint64(6), versions.LastSequence)
+
+	// Rolling over to a new manifest keeps the state and removes the old one
+	manifest, err = CreateManifest(dir, 2, versions)
+	assert.NoError(t, err)
+	assert.NoError(t, manifest.Close())
+
+	current, err := os.ReadFile(path.Join(dir, MANIFEST_CURRENT_FILE))
+	assert.NoError(t, err)
+	assert.Equal(t, "MANIFEST-000002\n", string(current))
+	_, err = os.Stat(path.Join(dir, "MANIFEST-000001"))
+	assert.True(t, os.IsNotExist(err))
+
+	rolled, number, err := ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), number)
+	assert.Equal(t, versions, rolled)
+}
+
+func TestManifestIgnoresTornEdit(t *testing.T) {
+	dir := t.TempDir()
+
+	manifest, err := CreateManifest(dir, 1, NewVersionSet())
+	assert.NoError(t, err)
+	assert.NoError(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0001"}}}))
+
+	// Simulate a crash in the middle of appending the next edit
+	payload, err := (&VersionEdit{AddedTables: []TableMetadata{{Name: "0002"}}}).MarshalBinary()
+	assert.NoError(t, err)
+	frame, err := encodeFrame(payload)
+	assert.NoError(t, err)
+	_, err = manifest.file.Write(frame[:len(frame)-3])
+	assert.NoError(t, err)
+	assert.NoError(t, manifest.Close())
+
+	versions, _, err := ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]TableMetadata{"0001": {Name: "0001"}}, versions.Tables)
+}
+
+func TestManifestFailsOnCorruptEditBeforeOthers(t *testing.T) {
+	dir := t.TempDir()
+
+	manifest, err := CreateManifest(dir, 1, NewVersionSet())
+	assert.NoError(t, err)
+	assert.NoError(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0001"}}}))
+
+	// A damaged edit in the middle of the manifest
+	payload, err := (&VersionEdit{AddedTables: []TableMetadata{{Name: "0002"}}}).MarshalBinary()
+	assert.NoError(t, err)
+	frame, err := encodeFrame(payload)
+	assert.NoError(t, err)
+	frame[len(frame)-1] ^= 0xFF
+	_, err = manifest.file.Write(frame)
+	assert.NoError(t, err)
+	assert.NoError(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0003"}}}))
+	assert.NoError(t, manifest.Close())
+
+	_, _, err = ReadManifest(dir)
+	var corruption *WALCorruptionError
+	assert.ErrorAs(t, err, &corruption)
+}
+
+func TestManifestAppendUndoesPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	manifest, err := CreateManifest(dir, 1, NewVersionSet())
+	assert.NoError(t, err)
+	manifest.file = &failingLogFile{logFile: manifest.file, failNext: true}
+	assert.Error(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0001"}}}))
+
+	// Later edits are appended right after the last whole one
+	assert.NoError(t, manifest.Append(&VersionEdit{AddedTables: []TableMetadata{{Name: "0002"}}}))
+	assert.NoError(t, manifest.Close())
+
+	versions, _, err := ReadManifest(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]TableMetadata{"0002": {Name: "0002"}}, versions.Tables)
+}
+
+func TestManifestAppendFailsAfterUndoFails(t *testing.T) {
+	manifest, err := CreateManifest(t.TempDir(), 1, NewVersionSet())
+	assert.NoError(t, err)
+	t.Cleanup(func() { manifest.Close() })
+	manifest.file = &failingLogFile{logFile: manifest.file, failNext: true, failTruncate: true}
+
+	assert.ErrorIs(t, manifest.Append(&VersionEdit{LastSequence: 1}), ErrManifestFailed)
+	assert.ErrorIs(t, manifest.Append(&VersionEdit{LastSequence: 2}), ErrManifestFailed)
+}
@@ -1,23 +1,117 @@
 package core
 
 import (
+	"fmt"
+	"iter"
 	"strings"
+	"time"
+	"unsafe"
 
 	"github.com/ogioldat/ttrunksdb/algo"
 )
 
+// MemTable keeps the newest version of every key written since the last
+// flush, and the older versions live snapshots still read. The newest one is
+// stored in the node returned by Get, older ones are chained through
+// Node.Older, newest first.
 type MemTable interface {
 	Append(string, []byte) error
+	Delete(string) error
+	Apply(record DBRecord, lastSnapshot uint64) error
 	Read(string) (data []byte, ok bool)
+	Get(string) *algo.Node
+	GetAt(key string, seqNumber uint64) *algo.Node
 	Reset()
 	Size() int
+	ApproximateSize() int
 	Last() *algo.Node
 	First() *algo.Node
-	Iterator() <-chan *algo.Node
+	Iterator() iter.Seq[*algo.Node]
+	IteratorFrom(start string) iter.Seq[*algo.Node]
+	Cursor() MemTableCursor
 }
 
+// MemTableCursor walks the newest versions of the keys of a memtable in
+// either direction. It is invalid until positioned and once it moves past
+// either end.
+type MemTableCursor interface {
+	Valid() bool
+	Node() *algo.Node
+	Seek(key string)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+}
+
+// MemTableType selects the MemTable implementation of the storage.
+type MemTableType int
+
+const (
+	// MemTableRBTree is a red-black tree. It relies on the storage's lock.
+	MemTableRBTree MemTableType = iota
+	// MemTableSkipList is a lock-free skiplist, safe for concurrent use. The
+	// storage still serializes writes under its lock, see
+	// BenchmarkDBConcurrent.
+	MemTableSkipList
+)
+
+var memTableTypeNames = map[MemTableType]string{
+	MemTableRBTree:   "rbtree",
+	MemTableSkipList: "skiplist",
+}
+
+func (t MemTableType) String() string {
+	if name, ok := memTableTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MemTableType(%d)", int(t))
+}
+
+func ParseMemTableType(name string) (MemTableType, error) {
+	for memTableType, typeName := range memTableTypeNames {
+		if typeName == strings.ToLower(name) {
+			return memTableType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown memtable type: %s", name)
+}
+
+func NewMemTable(memTableType MemTableType) MemTable {
+	if memTableType == MemTableSkipList {
+		return NewSkipListMemTable()
+	}
+	return NewRBMemTable()
+}
+
+// Memory taken by a memtable entry besides its key and value
+const MEMTABLE_ENTRY_OVERHEAD = int(unsafe.Sizeof(algo.Node{}))
+
+func memTableEntrySize(key string, value []byte) int {
+	return MEMTABLE_ENTRY_OVERHEAD + len(key) + len(value)
+}
+
+// snapshotReads reports whether the newest live snapshot, taken at
+// lastSnapshot, reads the version written at seqNumber. A lastSnapshot of 0
+// means there is none.
+func snapshotReads(lastSnapshot uint64, seqNumber uint64) bool {
+	return lastSnapshot > 0 && seqNumber <= lastSnapshot
+}
+
+// recordTime returns the time record was written at. Records without a
+// timestamp are stamped now.
+func recordTime(record DBRecord) time.Time {
+	if record.Timestamp == 0 {
+		return time.Now()
+	}
+	return time.Unix(int64(record.Timestamp), 0)
+}
+
+// RBMemTable is not safe for concurrent use; LSMTStorage guards it.
 type RBMemTable struct {
-	tree *algo.RBTree
+	tree  *algo.RBTree
+	older int // Versions chained behind the newest one of their key
+	bytes int // Approximate memory taken by the entries
 }
 
 func NewRBMemTable() *RBMemTable {
@@ -41,25 +135,93 @@ func NewFromKVPairs(kvStr string) (*RBMemTable, error) {
 	return memTable, nil
 }
 
+// Append stores value for key without a sequence number, replacing the
+// current version of the key.
 func (r *RBMemTable) Append(key string, value []byte) error {
-	r.tree.Insert(key, value)
+	r.put(DBRecord{Key: DBRecordKey(key), Value: value}, 0)
+	return nil
+}
+
+// Delete stores a tombstone for key, which shadows older values of the key
+// kept in SSTables until it is compacted away.
+func (r *RBMemTable) Delete(key string) error {
+	r.put(DBRecord{Key: DBRecordKey(key), Tombstone: true}, 0)
+	return nil
+}
+
+// Apply stores record as the newest version of its key. The current version
+// is kept behind it only while the newest live snapshot, taken at
+// lastSnapshot, reads it; 0 means there is no live snapshot.
+func (r *RBMemTable) Apply(record DBRecord, lastSnapshot uint64) error {
+	r.put(record, lastSnapshot)
 	return nil
 }
 
+func (r *RBMemTable) put(record DBRecord, lastSnapshot uint64) {
+	key, value := string(record.Key), []byte(record.Value)
+	node := r.tree.Search(key)
+	if node == nil {
+		node = r.tree.Insert(key, value)
+		r.bytes += memTableEntrySize(key, value)
+	} else if snapshotReads(lastSnapshot, node.Metadata.SeqNumber) {
+		// The node stays in the tree, so the current version moves out of it
+		node.Older = &algo.Node{
+			Key:      node.Key,
+			Value:    node.Value,
+			Metadata: node.Metadata,
+			Older:    node.Older,
+		}
+		r.older++
+		r.bytes += memTableEntrySize(key, value)
+	} else {
+		r.bytes += len(value) - len(node.Value)
+	}
+	node.Value = value
+	node.Metadata.Timestamp = recordTime(record)
+	node.Metadata.Tombstone = bool(record.Tombstone)
+	node.Metadata.SeqNumber = record.SeqNumber
+}
+
+// Read returns the live value of key; deleted keys are reported as missing.
 func (r *RBMemTable) Read(key string) (data []byte, ok bool) {
 	value := r.tree.Search(key)
-	if value != nil {
+	if value != nil && !value.Metadata.Tombstone {
 		return value.Value, true
 	}
 	return nil, false
 }
 
+// Get returns the entry stored for key, including tombstones.
+func (r *RBMemTable) Get(key string) *algo.Node {
+	return r.tree.Search(key)
+}
+
+// GetAt returns the newest version of key written at or before seqNumber,
+// including tombstones.
+func (r *RBMemTable) GetAt(key string, seqNumber uint64) *algo.Node {
+	version := r.tree.Search(key)
+	for version != nil && version.Metadata.SeqNumber > seqNumber {
+		version = version.Older
+	}
+	return version
+}
+
 func (r *RBMemTable) Reset() {
 	r.tree = algo.NewRBTree()
+	r.older = 0
+	r.bytes = 0
 }
 
+// Size returns the number of records held, the older versions kept for
+// snapshots included.
 func (r *RBMemTable) Size() int {
-	return r.tree.NodesCount
+	return r.tree.NodesCount + r.older
+}
+
+// ApproximateSize returns the memory taken by the entries in bytes: their
+// keys, values and per entry overhead.
+func (r *RBMemTable) ApproximateSize() int {
+	return r.bytes
 }
 
 func (r *RBMemTable) Last() *algo.Node {
@@ -70,6 +232,15 @@ func (r *RBMemTable) First() *algo.Node {
 	return r.tree.First()
 }
 
-func (r *RBMemTable) Iterator() <-chan *algo.Node {
-	return r.tree.StreamInorderTraversal()
+func (r *RBMemTable) Iterator() iter.Seq[*algo.Node] {
+	return r.tree.All()
+}
+
+// IteratorFrom yields the entries with keys from start on, in order.
+func (r *RBMemTable) IteratorFrom(start string) iter.Seq[*algo.Node] {
+	return r.tree.From(start)
+}
+
+func (r *RBMemTable) Cursor() MemTableCursor {
+	return r.tree.Cursor()
 }
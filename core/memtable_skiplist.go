@@ -0,0 +1,139 @@
+package core
+
+import (
+	"iter"
+	"sync/atomic"
+
+	"github.com/ogioldat/ttrunksdb/algo"
+)
+
+// SkipListMemTable is a MemTable safe for concurrent use: writers insert
+// through a lock-free skiplist and readers never wait for them. Stored nodes
+// are never modified, a write stores a new node for its key.
+type SkipListMemTable struct {
+	list  *algo.SkipList
+	older atomic.Int64 // Versions chained behind the newest one of their key
+	bytes atomic.Int64 // Approximate memory taken by the entries
+}
+
+func NewSkipListMemTable() *SkipListMemTable {
+	return &SkipListMemTable{list: algo.NewSkipList()}
+}
+
+// Append stores value for key without a sequence number, replacing the
+// current version of the key.
+func (m *SkipListMemTable) Append(key string, value []byte) error {
+	m.put(DBRecord{Key: DBRecordKey(key), Value: value}, 0)
+	return nil
+}
+
+// Delete stores a tombstone for key, which shadows older values of the key
+// kept in SSTables until it is compacted away.
+func (m *SkipListMemTable) Delete(key string) error {
+	m.put(DBRecord{Key: DBRecordKey(key), Tombstone: true}, 0)
+	return nil
+}
+
+// Apply stores record as the newest version of its key. The current version
+// is kept behind it only while the newest live snapshot, taken at
+// lastSnapshot, reads it; 0 means there is no live snapshot.
+func (m *SkipListMemTable) Apply(record DBRecord, lastSnapshot uint64) error {
+	m.put(record, lastSnapshot)
+	return nil
+}
+
+func (m *SkipListMemTable) put(record DBRecord, lastSnapshot uint64) {
+	key, value := string(record.Key), []byte(record.Value)
+	timestamp := recordTime(record)
+	// Set by the last, successful, call of the upsert function
+	keepOlder := false
+	previous := m.list.Upsert(key, func(current *algo.Node) *algo.Node {
+		node := &algo.Node{Key: key, Value: value}
+		node.Metadata.Timestamp = timestamp
+		node.Metadata.Tombstone = bool(record.Tombstone)
+		node.Metadata.SeqNumber = record.SeqNumber
+		keepOlder = current != nil && snapshotReads(lastSnapshot, current.Metadata.SeqNumber)
+		if current != nil {
+			node.Older = current.Older
+			if keepOlder {
+				node.Older = current
+			}
+		}
+		return node
+	})
+
+	switch {
+	case previous == nil:
+		m.bytes.Add(int64(memTableEntrySize(key, value)))
+	case keepOlder:
+		m.older.Add(1)
+		m.bytes.Add(int64(memTableEntrySize(key, value)))
+	default:
+		m.bytes.Add(int64(len(value) - len(previous.Value)))
+	}
+}
+
+// Read returns the live value of key; deleted keys are reported as missing.
+func (m *SkipListMemTable) Read(key string) (data []byte, ok bool) {
+	node := m.list.Search(key)
+	if node != nil && !node.Metadata.Tombstone {
+		return node.Value, true
+	}
+	return nil, false
+}
+
+// Get returns the entry stored for key, including tombstones.
+func (m *SkipListMemTable) Get(key string) *algo.Node {
+	return m.list.Search(key)
+}
+
+// GetAt returns the newest version of key written at or before seqNumber,
+// including tombstones.
+func (m *SkipListMemTable) GetAt(key string, seqNumber uint64) *algo.Node {
+	version := m.list.Search(key)
+	for version != nil && version.Metadata.SeqNumber > seqNumber {
+		version = version.Older
+	}
+	return version
+}
+
+// Reset empties the memtable. Unlike the other methods, it must not be called
+// concurrently.
+func (m *SkipListMemTable) Reset() {
+	m.list = algo.NewSkipList()
+	m.older.Store(0)
+	m.bytes.Store(0)
+}
+
+// Size returns the number of records held, the older versions kept for
+// snapshots included.
+func (m *SkipListMemTable) Size() int {
+	return m.list.Len() + int(m.older.Load())
+}
+
+// ApproximateSize returns the memory taken by the entries in bytes: their
+// keys, values and per entry overhead.
+func (m *SkipListMemTable) ApproximateSize() int {
+	return int(m.bytes.Load())
+}
+
+func (m *SkipListMemTable) Last() *algo.Node {
+	return m.list.Last()
+}
+
+func (m *SkipListMemTable) First() *algo.Node {
+	return m.list.First()
+}
+
+func (m *SkipListMemTable) Iterator() iter.Seq[*algo.Node] {
+	return m.list.All()
+}
+
+// IteratorFrom yields the entries with keys from start on, in order.
+func (m *SkipListMemTable) IteratorFrom(start string) iter.Seq[*algo.Node] {
+	return m.list.From(start)
+}
+
+func (m *SkipListMemTable) Cursor() MemTableCursor {
+	return m.list.Cursor()
+}
@@ -1,7 +1,13 @@
 package core
 
 import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,78 +22,97 @@ func TestLoadFromKV(t *testing.T) {
 	assert.Equal(t, "bbb", sstable.Last().Key)
 }
 
-func TestRBMemTableWrite(t *testing.T) {
-	memTable := NewRBMemTable()
+// forEachMemTable runs test against every MemTable implementation.
+func forEachMemTable(t *testing.T, test func(t *testing.T, newMemTable func() MemTable)) {
+	for _, memTableType := range []MemTableType{MemTableRBTree, MemTableSkipList} {
+		t.Run(memTableType.String(), func(t *testing.T) {
+			test(t, func() MemTable { return NewMemTable(memTableType) })
+		})
+	}
+}
 
-	err := memTable.Append("key1", []byte("value1"))
-	assert.NoError(t, err)
-	assert.Equal(t, 1, memTable.Size())
+func TestMemTableWrite(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
 
-	err = memTable.Append("key2", []byte("value2"))
-	assert.NoError(t, err)
-	assert.Equal(t, 2, memTable.Size())
+		err := memTable.Append("key1", []byte("value1"))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, memTable.Size())
+
+		err = memTable.Append("key2", []byte("value2"))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, memTable.Size())
+	})
 }
 
-func TestRBMemTableRead(t *testing.T) {
-	memTable := NewRBMemTable()
+func TestMemTableRead(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
 
-	memTable.Append("test_key", []byte("test_value"))
+		memTable.Append("test_key", []byte("test_value"))
 
-	value, ok := memTable.Read("test_key")
-	assert.True(t, ok)
-	assert.Equal(t, []byte("test_value"), value)
+		value, ok := memTable.Read("test_key")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("test_value"), value)
 
-	_, ok = memTable.Read("non_existent")
-	assert.False(t, ok)
+		_, ok = memTable.Read("non_existent")
+		assert.False(t, ok)
+	})
 }
 
-func TestRBMemTableReset(t *testing.T) {
-	memTable := NewRBMemTable()
+func TestMemTableReset(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
 
-	memTable.Append("key1", []byte("value1"))
-	memTable.Append("key2", []byte("value2"))
-	assert.Equal(t, 2, memTable.Size())
+		memTable.Append("key1", []byte("value1"))
+		memTable.Append("key2", []byte("value2"))
+		assert.Equal(t, 2, memTable.Size())
 
-	memTable.Reset()
-	assert.Equal(t, 0, memTable.Size())
+		memTable.Reset()
+		assert.Equal(t, 0, memTable.Size())
 
-	_, ok := memTable.Read("key1")
-	assert.False(t, ok)
+		_, ok := memTable.Read("key1")
+		assert.False(t, ok)
+	})
 }
 
-func TestRBMemTableFirstLast(t *testing.T) {
-	memTable := NewRBMemTable()
+func TestMemTableFirstLast(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
 
-	memTable.Append("b", []byte("value_b"))
-	memTable.Append("a", []byte("value_a"))
-	memTable.Append("c", []byte("value_c"))
+		memTable.Append("b", []byte("value_b"))
+		memTable.Append("a", []byte("value_a"))
+		memTable.Append("c", []byte("value_c"))
 
-	first := memTable.First()
-	assert.Equal(t, "a", first.Key)
-	assert.Equal(t, []byte("value_a"), first.Value)
+		first := memTable.First()
+		assert.Equal(t, "a", first.Key)
+		assert.Equal(t, []byte("value_a"), first.Value)
 
-	last := memTable.Last()
-	assert.Equal(t, "c", last.Key)
-	assert.Equal(t, []byte("value_c"), last.Value)
+		last := memTable.Last()
+		assert.Equal(t, "c", last.Key)
+		assert.Equal(t, []byte("value_c"), last.Value)
+	})
 }
 
-func TestRBMemTableIterator(t *testing.T) {
-	memTable := NewRBMemTable()
+func TestMemTableIterator(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
 
-	memTable.Append("b", []byte("value_b"))
-	memTable.Append("a", []byte("value_a"))
-	memTable.Append("c", []byte("value_c"))
+		memTable.Append("b", []byte("value_b"))
+		memTable.Append("a", []byte("value_a"))
+		memTable.Append("c", []byte("value_c"))
 
-	var keys []string
-	var values [][]byte
+		var keys []string
+		var values [][]byte
 
-	for kv := range memTable.Iterator() {
-		keys = append(keys, kv.Key)
-		values = append(values, kv.Value)
-	}
+		for kv := range memTable.Iterator() {
+			keys = append(keys, kv.Key)
+			values = append(values, kv.Value)
+		}
 
-	assert.Equal(t, []string{"a", "b", "c"}, keys)
-	assert.Equal(t, [][]byte{[]byte("value_a"), []byte("value_b"), []byte("value_c")}, values)
+		assert.Equal(t, []string{"a", "b", "c"}, keys)
+		assert.Equal(t, [][]byte{[]byte("value_a"), []byte("value_b"), []byte("value_c")}, values)
+	})
 }
 
 func TestNewFromKVPairsError(t *testing.T) {
@@ -105,3 +130,292 @@ func TestNewFromKVPairsEmpty(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 0, memTable.Size())
 }
+
+func TestMemTableOverwrite(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+
+		memTable.Append("key", []byte("old"))
+		memTable.Append("key", []byte("new"))
+
+		assert.Equal(t, 1, memTable.Size())
+		value, ok := memTable.Read("key")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("new"), value)
+	})
+}
+
+func TestMemTableDelete(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+
+		memTable.Append("key", []byte("value"))
+		err := memTable.Delete("key")
+		assert.NoError(t, err)
+
+		_, ok := memTable.Read("key")
+		assert.False(t, ok)
+
+		node := memTable.Get("key")
+		assert.NotNil(t, node)
+		assert.True(t, node.Metadata.Tombstone)
+		assert.Equal(t, 1, memTable.Size())
+
+		memTable.Append("key", []byte("revived"))
+		value, ok := memTable.Read("key")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("revived"), value)
+	})
+}
+
+func TestMemTableIteratorFrom(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+
+		for _, key := range []string{"d", "b", "f", "a", "e", "c", "g"} {
+			memTable.Append(key, []byte("value_"+key))
+		}
+
+		testCases := map[string][]string{
+			"":   {"a", "b", "c", "d", "e", "f", "g"},
+			"c":  {"c", "d", "e", "f", "g"},
+			"cc": {"d", "e", "f", "g"},
+			"z":  nil,
+		}
+
+		for start, expected := range testCases {
+			var keys []string
+			for kv := range memTable.IteratorFrom(start) {
+				keys = append(keys, kv.Key)
+			}
+			assert.Equal(t, expected, keys, "start %q", start)
+		}
+	})
+}
+
+func TestMemTableCursor(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+		cursor := memTable.Cursor()
+		cursor.Seek("")
+		assert.False(t, cursor.Valid())
+
+		for _, key := range []string{"d", "b", "f", "a", "e", "c", "g"} {
+			memTable.Append(key, []byte("value_"+key))
+		}
+
+		cursor.Seek("cc")
+		assert.Equal(t, "d", cursor.Node().Key)
+		cursor.Prev()
+		assert.Equal(t, "c", cursor.Node().Key)
+		cursor.Next()
+		cursor.Next()
+		assert.Equal(t, "e", cursor.Node().Key)
+		assert.Equal(t, []byte("value_e"), cursor.Node().Value)
+
+		var forward []string
+		for cursor.SeekToFirst(); cursor.Valid(); cursor.Next() {
+			forward = append(forward, cursor.Node().Key)
+		}
+		assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g"}, forward)
+
+		var backward []string
+		for cursor.SeekToLast(); cursor.Valid(); cursor.Prev() {
+			backward = append(backward, cursor.Node().Key)
+		}
+		assert.Equal(t, []string{"g", "f", "e", "d", "c", "b", "a"}, backward)
+
+		cursor.Seek("z")
+		assert.False(t, cursor.Valid())
+		assert.Nil(t, cursor.Node())
+	})
+}
+
+func TestMemTableIteratorStopsEarly(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+		for _, key := range []string{"a", "b", "c", "d"} {
+			memTable.Append(key, []byte("value_"+key))
+		}
+
+		var keys []string
+		for node := range memTable.IteratorFrom("b") {
+			keys = append(keys, node.Key)
+			if len(keys) == 2 {
+				break
+			}
+		}
+		assert.Equal(t, []string{"b", "c"}, keys)
+	})
+}
+
+func TestMemTableVersions(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+
+		// Snapshots taken at 2 and 4 read the versions before them
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v1"), SeqNumber: 1}, 0)
+		memTable.Apply(DBRecord{Key: "key", Tombstone: true, SeqNumber: 3}, 2)
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v5"), SeqNumber: 5}, 4)
+
+		assert.Equal(t, 3, memTable.Size())
+		assert.Equal(t, []byte("v5"), memTable.Get("key").Value)
+
+		assert.Nil(t, memTable.GetAt("key", 0))
+		assert.Equal(t, []byte("v1"), memTable.GetAt("key", 2).Value)
+		assert.True(t, memTable.GetAt("key", 4).Metadata.Tombstone)
+		assert.Equal(t, []byte("v5"), memTable.GetAt("key", 5).Value)
+
+		var seqNumbers []uint64
+		for _, record := range collect(t, NewMemTableIterator(memTable)) {
+			seqNumbers = append(seqNumbers, record.SeqNumber)
+		}
+		assert.Equal(t, []uint64{5, 3, 1}, seqNumbers)
+	})
+}
+
+func TestMemTableDropsVersionsNoSnapshotReads(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v1"), SeqNumber: 1}, 0)
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v2"), SeqNumber: 2}, 0)
+		assert.Equal(t, 1, memTable.Size())
+
+		// A snapshot taken at 2 reads v2, but not v4 written after it
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v4"), SeqNumber: 4}, 2)
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v5"), SeqNumber: 5}, 2)
+		assert.Equal(t, 2, memTable.Size())
+		assert.Equal(t, []byte("v5"), memTable.Get("key").Value)
+		assert.Equal(t, []byte("v2"), memTable.Get("key").Older.Value)
+	})
+}
+
+func TestMemTableKeepsRecordTimestamp(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+
+		memTable.Apply(DBRecord{Key: "replayed", Value: DBRecordValue("v"), Timestamp: 1700000000, SeqNumber: 1}, 0)
+		assert.Equal(t, time.Unix(1700000000, 0), memTable.Get("replayed").Metadata.Timestamp)
+
+		// Records without a timestamp are stamped on insert
+		memTable.Apply(DBRecord{Key: "new", Value: DBRecordValue("v"), SeqNumber: 2}, 0)
+		assert.WithinDuration(t, time.Now(), memTable.Get("new").Metadata.Timestamp, time.Second)
+	})
+}
+
+func TestMemTableApproximateSize(t *testing.T) {
+	forEachMemTable(t, func(t *testing.T, newMemTable func() MemTable) {
+		memTable := newMemTable()
+		assert.Equal(t, 0, memTable.ApproximateSize())
+
+		memTable.Append("key", []byte("value"))
+		assert.Equal(t, MEMTABLE_ENTRY_OVERHEAD+8, memTable.ApproximateSize())
+
+		// Overwriting in place only accounts for the value size difference
+		memTable.Append("key", []byte("v"))
+		assert.Equal(t, MEMTABLE_ENTRY_OVERHEAD+4, memTable.ApproximateSize())
+
+		// Every version kept for a snapshot takes an entry of its own
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("value"), SeqNumber: 1}, 1)
+		assert.Equal(t, 2*MEMTABLE_ENTRY_OVERHEAD+12, memTable.ApproximateSize())
+
+		// Versions no snapshot reads anymore are overwritten in place
+		memTable.Apply(DBRecord{Key: "key", Value: DBRecordValue("v"), SeqNumber: 2}, 0)
+		assert.Equal(t, 2*MEMTABLE_ENTRY_OVERHEAD+8, memTable.ApproximateSize())
+
+		memTable.Reset()
+		assert.Equal(t, 0, memTable.ApproximateSize())
+	})
+}
+
+func TestSkipListMemTableConcurrentWrites(t *testing.T) {
+	memTable := NewSkipListMemTable()
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				key := fmt.Sprintf("key_%04d", i)
+				// A snapshot reading every version keeps all of them
+				memTable.Apply(DBRecord{Key: DBRecordKey(key), Value: DBRecordValue(fmt.Sprint(w)), SeqNumber: uint64(w*500 + i + 1)}, math.MaxUint64)
+				memTable.Read(key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every write is kept, either as the newest version or chained behind it
+	assert.Equal(t, 8*500, memTable.Size())
+
+	var keys []string
+	for node := range memTable.Iterator() {
+		keys = append(keys, node.Key)
+	}
+	assert.Len(t, keys, 500)
+	assert.True(t, sort.StringsAreSorted(keys))
+}
+
+func BenchmarkMemTableWrite(b *testing.B) {
+	value := []byte("value")
+
+	b.Run("rbtree", func(b *testing.B) {
+		// The red-black tree needs the caller's lock, as LSMTStorage provides
+		var mu sync.Mutex
+		memTable := NewRBMemTable()
+		var seq atomic.Uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				n := seq.Add(1)
+				mu.Lock()
+				memTable.Apply(DBRecord{Key: DBRecordKey(fmt.Sprintf("key_%d", n%100000)), Value: value, SeqNumber: n}, 0)
+				mu.Unlock()
+			}
+		})
+	})
+
+	b.Run("skiplist", func(b *testing.B) {
+		memTable := NewSkipListMemTable()
+		var seq atomic.Uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				n := seq.Add(1)
+				memTable.Apply(DBRecord{Key: DBRecordKey(fmt.Sprintf("key_%d", n%100000)), Value: value, SeqNumber: n}, 0)
+			}
+		})
+	})
+}
+
+func BenchmarkMemTableRead(b *testing.B) {
+	bench := func(b *testing.B, memTable MemTable, lock sync.Locker) {
+		for i := range 100000 {
+			memTable.Append(fmt.Sprintf("key_%d", i), []byte("value"))
+		}
+		var seq atomic.Uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key := fmt.Sprintf("key_%d", seq.Add(1)%100000)
+				lock.Lock()
+				memTable.Read(key)
+				lock.Unlock()
+			}
+		})
+	}
+
+	b.Run("rbtree", func(b *testing.B) {
+		var mu sync.RWMutex
+		bench(b, NewRBMemTable(), mu.RLocker())
+	})
+	b.Run("skiplist", func(b *testing.B) {
+		bench(b, NewSkipListMemTable(), noLock{})
+	})
+}
+
+// noLock stands in for a lock around memtables that need none.
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"slices"
+	"sort"
+)
+
+var ErrSnapshotReleased = errors.New("snapshot released")
+
+// Snapshot is a read-only view of the database as of the moment it was
+// taken. Writes made afterwards are not visible through it. Flushes and
+// compactions keep the versions a snapshot reads until it is released.
+type Snapshot struct {
+	db        *LSMTStorage
+	seqNumber uint64
+	released  bool
+}
+
+// Snapshot returns a view of the current state of s. It must be released
+// once it is no longer needed, so that old versions can be compacted away.
+func (s *LSMTStorage) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots[s.seqNumber]++
+	return &Snapshot{db: s, seqNumber: s.seqNumber}
+}
+
+// SeqNumber returns the sequence number of the last write the snapshot sees.
+func (snap *Snapshot) SeqNumber() uint64 {
+	return snap.seqNumber
+}
+
+func (snap *Snapshot) Read(key string) ([]byte, error) {
+	snap.db.mu.RLock()
+	defer snap.db.mu.RUnlock()
+
+	if snap.released {
+		return nil, ErrSnapshotReleased
+	}
+	return snap.db.readAt(key, snap.seqNumber)
+}
+
+// Scan returns the keys live in the snapshot in [start, end), at most limit
+// of them. See LSMTStorage.Scan.
+func (snap *Snapshot) Scan(start, end string, limit int) ([]KeyValue, error) {
+	snap.db.mu.RLock()
+	defer snap.db.mu.RUnlock()
+
+	if snap.released {
+		return nil, ErrSnapshotReleased
+	}
+	return snap.db.scanAt(start, end, limit, snap.seqNumber)
+}
+
+func (snap *Snapshot) ScanPrefix(prefix string) ([]KeyValue, error) {
+	return snap.Scan(prefix, PrefixEnd(prefix), 0)
+}
+
+// Release lets the storage drop the versions only the snapshot still needed.
+// Releasing a snapshot twice is a no-op.
+func (snap *Snapshot) Release() {
+	snap.db.mu.Lock()
+	defer snap.db.mu.Unlock()
+
+	if snap.released {
+		return
+	}
+	snap.released = true
+
+	if snap.db.snapshots[snap.seqNumber]--; snap.db.snapshots[snap.seqNumber] == 0 {
+		delete(snap.db.snapshots, snap.seqNumber)
+	}
+}
+
+// liveSnapshots returns the sequence numbers of the live snapshots in
+// ascending order. s.mu must be held.
+func (s *LSMTStorage) liveSnapshots() []uint64 {
+	snapshots := make([]uint64, 0, len(s.snapshots))
+	for seqNumber := range s.snapshots {
+		snapshots = append(snapshots, seqNumber)
+	}
+	slices.Sort(snapshots)
+	return snapshots
+}
+
+// lastSnapshot returns the sequence number of the newest live snapshot, or 0
+// when there is none. s.mu must be held.
+func (s *LSMTStorage) lastSnapshot() uint64 {
+	var last uint64
+	for seqNumber := range s.snapshots {
+		last = max(last, seqNumber)
+	}
+	return last
+}
+
+// retainingIterator drops the versions no reader can see anymore. A snapshot
+// sees the newest version written at or before it, so of the versions
+// between two neighbouring snapshots only the newest one is kept, and so is
+// the newest version overall for reads of the latest state.
+type retainingIterator struct {
+	source     RecordIterator
+	snapshots  []uint64 // Ascending
+	bottommost bool
+	lastKey    DBRecordKey
+	lastStripe int // Stripe of the last version kept or dropped of lastKey
+	started    bool
+}
+
+// newRetainingIterator filters source, whose versions of a key come newest
+// first. When bottommost, no older version of a key exists outside source,
+// so a tombstone no snapshot needs is dropped too.
+func newRetainingIterator(source RecordIterator, snapshots []uint64, bottommost bool) RecordIterator {
+	return &retainingIterator{source: source, snapshots: snapshots, bottommost: bottommost}
+}
+
+// stripe returns the index of the oldest snapshot that sees seqNumber, or
+// len(snapshots) when only the latest state does.
+func (it *retainingIterator) stripe(seqNumber uint64) int {
+	return sort.Search(len(it.snapshots), func(i int) bool {
+		return it.snapshots[i] >= seqNumber
+	})
+}
+
+func (it *retainingIterator) Next() (*DBRecord, error) {
+	for {
+		record, err := it.source.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		stripe := it.stripe(record.SeqNumber)
+		if it.started && record.Key == it.lastKey && stripe == it.lastStripe {
+			// Shadowed by a newer version every reader of the stripe sees
+			continue
+		}
+		it.started, it.lastKey, it.lastStripe = true, record.Key, stripe
+
+		// Versions of the oldest stripe below a tombstone are dropped, so it
+		// has nothing left to shadow
+		if it.bottommost && bool(record.Tombstone) && stripe == 0 {
+			continue
+		}
+		return record, nil
+	}
+}
+
+func (it *retainingIterator) Close() error {
+	return it.source.Close()
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRead(t *testing.T) {
+	db := newCompactionTestStorage(t, t.TempDir(), WithMemtableThreshold(6), WithL0CompactionTrigger(1))
+
+	db.Write("a", []byte("a1"))
+	db.Write("b", []byte("b1"))
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	db.Write("a", []byte("a2"))
+	db.Delete("b")
+	db.Write("c", []byte("c2"))
+
+	check := func() {
+		value, err := snapshot.Read("a")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("a1"), value)
+		value, err = snapshot.Read("b")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("b1"), value)
+		_, err = snapshot.Read("c")
+		assert.Error(t, err)
+
+		results, err := snapshot.Scan("", "", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []KeyValue{{Key: "a", Value: []byte("a1")}, {Key: "b", Value: []byte("b1")}}, results)
+	}
+
+	// Served from the memtables
+	check()
+
+	// Served from a table that keeps both versions of a and b
+	db.Write("d", []byte("d2"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+	assert.Empty(t, db.ssTableManager.sstables[0])
+	assert.Len(t, collect(t, db.ssTableManager.NewLevelIterator(1)), 6)
+	check()
+
+	value, err := db.Read("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a2"), value)
+	_, err = db.Read("b")
+	assert.Error(t, err)
+}
+
+func TestSnapshotRelease(t *testing.T) {
+	tempDir := t.TempDir()
+	db := newCompactionTestStorage(t, tempDir, WithMemtableThreshold(2), WithL0CompactionTrigger(2))
+
+	db.Write("a", []byte("a1"))
+	snapshot := db.Snapshot()
+	db.Delete("a")
+	db.Write("b", []byte("b2"))
+	db.Write("c", []byte("c2"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	// The bottom level keeps the value and the tombstone shadowing it
+	assert.Len(t, collect(t, db.ssTableManager.NewLevelIterator(1)), 4)
+
+	snapshot.Release()
+	snapshot.Release()
+	_, err := snapshot.Read("a")
+	assert.ErrorIs(t, err, ErrSnapshotReleased)
+	assert.Empty(t, db.snapshots)
+
+	db.Write("c", []byte("c3"))
+	db.Write("d", []byte("d3"))
+	db.Write("e", []byte("e3"))
+	db.Write("f", []byte("f3"))
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, db.Compact())
+
+	var keys []DBRecordKey
+	for _, record := range collect(t, db.ssTableManager.NewLevelIterator(1)) {
+		keys = append(keys, record.Key)
+	}
+	assert.Equal(t, []DBRecordKey{"b", "c", "d", "e", "f"}, keys)
+}
+
+func TestRetainingIterator(t *testing.T) {
+	source := func() RecordIterator {
+		return &sliceIterator{records: []DBRecord{
+			{Key: "a", Value: DBRecordValue("a6"), SeqNumber: 6},
+			{Key: "a", Value: DBRecordValue("a5"), SeqNumber: 5},
+			{Key: "a", Tombstone: true, SeqNumber: 3},
+			{Key: "a", Value: DBRecordValue("a2"), SeqNumber: 2},
+			{Key: "a", Value: DBRecordValue("a1"), SeqNumber: 1},
+			{Key: "b", Tombstone: true, SeqNumber: 4},
+		}}
+	}
+	seqNumbers := func(it RecordIterator) []uint64 {
+		var seqNumbers []uint64
+		for _, record := range collect(t, it) {
+			seqNumbers = append(seqNumbers, record.SeqNumber)
+		}
+		return seqNumbers
+	}
+
+	assert.Equal(t, []uint64{6, 4}, seqNumbers(newRetainingIterator(source(), nil, false)))
+	assert.Equal(t, []uint64{6}, seqNumbers(newRetainingIterator(source(), nil, true)))
+
+	// Snapshot 2 sees a2, snapshot 4 the tombstone of a and b, the latest
+	// state a6
+	snapshots := []uint64{2, 4}
+	assert.Equal(t, []uint64{6, 3, 2, 4}, seqNumbers(newRetainingIterator(source(), snapshots, false)))
+	assert.Equal(t, []uint64{6, 3, 2, 4}, seqNumbers(newRetainingIterator(source(), snapshots, true)))
+}
@@ -2,21 +2,44 @@ package core
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ogioldat/ttrunksdb/algo"
+	"github.com/ogioldat/ttrunksdb/internal"
 )
 
+const DEFAULT_SSTABLE_BLOCK_SIZE = 4 * KB
+const DEFAULT_BLOOM_BITS_PER_KEY = 10
+
+// ErrKeyNotFound is returned by Read when the SSTable does not hold the key.
+var ErrKeyNotFound = errors.New("key not found")
+
+// SSTableManager keeps the set of live SSTables. Changes to the set are
+// logged to the MANIFEST before they become visible, see LogAndApply. It is
+// not safe for concurrent use; LSMTStorage guards it.
 type SSTableManager struct {
 	sstables     map[int][]*SSTable
 	outputDir    string
 	seqNumber    int
 	serializer   SSTableSerializer
 	deserializer SSTableDeserializer
+	versions     *VersionSet
+	manifest     *Manifest
+	pending      map[string]*SSTable // Created tables not yet added to the version set
+	blockSize    int
+	// Bloom filters have a fixed size when set, else bloomBitsPerKey per key
+	bloomFilterSize int
+	bloomBitsPerKey int
 }
 
 type SSTable struct {
@@ -26,12 +49,24 @@ type SSTable struct {
 	BloomFilter *algo.BloomFilter
 	SparseIndex *algo.SparseIndex
 	CreatedAt   time.Time
+	MinKey      string
+	MaxKey      string
+	Size        int64
 	seqNumber   int
+	version     uint32                // Format version, which decides the record layout
+	dataOffset  int                   // Size of the header preceding the data block
+	indexKeys   []algo.SparseIndexKey // Sorted first keys of the blocks, for seeking
 }
 
-func (s *SSTable) AllKeys() []string {
-	// TODO List
-	return []string{"orange", "apple"}
+func (s *SSTable) Metadata() TableMetadata {
+	return TableMetadata{
+		Level:     s.Level,
+		Name:      s.Name,
+		SeqNumber: s.seqNumber,
+		Size:      s.Size,
+		MinKey:    s.MinKey,
+		MaxKey:    s.MaxKey,
+	}
 }
 
 func boolToInt(b bool) int {
@@ -42,12 +77,27 @@ func boolToInt(b bool) int {
 }
 
 func NewSSTableManager(config *LSMTStorageConfig) *SSTableManager {
+	blockSize := config.sstableBlockSize
+	if blockSize <= 0 {
+		blockSize = DEFAULT_SSTABLE_BLOCK_SIZE
+	}
+	bloomBitsPerKey := config.bloomBitsPerKey
+	if bloomBitsPerKey <= 0 {
+		bloomBitsPerKey = DEFAULT_BLOOM_BITS_PER_KEY
+	}
+
 	manager := &SSTableManager{
 		sstables:     make(map[int][]*SSTable),
 		outputDir:    path.Join(config.outputDir, "sstables"),
 		seqNumber:    0,
 		serializer:   &BinarySSTableSerializer{},
 		deserializer: &BinarySSTableDeserializer{},
+		versions:     NewVersionSet(),
+		pending:      make(map[string]*SSTable),
+		blockSize:    blockSize,
+
+		bloomFilterSize: config.sstableBloomFilterSize,
+		bloomBitsPerKey: bloomBitsPerKey,
 	}
 
 	return manager
@@ -57,9 +107,12 @@ func (m *SSTableManager) FilePath(name string, level int) string {
 	return path.Join(m.outputDir, "level_"+fmt.Sprint(level), name+".bin")
 }
 
-func (m *SSTableManager) AddSSTable(config *LSMTStorageConfig) *SSTable {
-	level := 0
-	nextName := fmt.Sprintf("%04d", len(m.sstables[level])+1)
+// NewSSTable creates an empty table at level. The table is not live until it
+// is flushed and added through LogAndApply.
+func (m *SSTableManager) NewSSTable(config *LSMTStorageConfig, level int) *SSTable {
+	// Tables are numbered across all levels, so names never collide
+	m.seqNumber++
+	nextName := fmt.Sprintf("%04d", m.seqNumber)
 	sstable := &SSTable{
 		Level:       level,
 		Name:        nextName,
@@ -69,41 +122,342 @@ func (m *SSTableManager) AddSSTable(config *LSMTStorageConfig) *SSTable {
 		seqNumber:   m.seqNumber,
 		SparseIndex: algo.NewSparseIndex(),
 	}
-	m.sstables[level] = append(m.sstables[level], sstable)
-	m.seqNumber++
+	m.pending[nextName] = sstable
 
 	return sstable
 }
 
-func (m *SSTableManager) Read(s *SSTable, key string) (*DBRecord, error) {
-	file, err := os.Open(s.Path)
+// AddSSTable creates a table at level 0 and registers it right away, without
+// logging it to the MANIFEST.
+func (m *SSTableManager) AddSSTable(config *LSMTStorageConfig) *SSTable {
+	sstable := m.NewSSTable(config, 0)
+	delete(m.pending, sstable.Name)
+	m.register(sstable)
+
+	return sstable
+}
+
+// register adds sstable to its level. Level 0 is kept in flush order, deeper
+// levels hold disjoint key ranges and are kept sorted by key.
+func (m *SSTableManager) register(sstable *SSTable) {
+	level := sstable.Level
+	m.sstables[level] = append(m.sstables[level], sstable)
+	sort.Slice(m.sstables[level], func(i, j int) bool {
+		if level == 0 {
+			return m.sstables[level][i].seqNumber < m.sstables[level][j].seqNumber
+		}
+		return m.sstables[level][i].MinKey < m.sstables[level][j].MinKey
+	})
+}
+
+func (m *SSTableManager) unregister(name string, level int) *SSTable {
+	for i, sstable := range m.sstables[level] {
+		if sstable.Name == name {
+			m.sstables[level] = slices.Delete(m.sstables[level], i, i+1)
+			return sstable
+		}
+	}
+	return nil
+}
+
+// LogAndApply durably records edit in the MANIFEST and then installs it.
+// Added tables must have been created with NewSSTable and flushed.
+func (m *SSTableManager) LogAndApply(edit *VersionEdit) error {
+	for _, table := range edit.AddedTables {
+		if _, ok := m.pending[table.Name]; !ok {
+			return fmt.Errorf("unknown sstable: %s", table.Name)
+		}
+	}
+
+	edit.NextFileNumber = m.seqNumber + 1
+	if m.manifest != nil {
+		if err := m.manifest.Append(edit); err != nil {
+			return err
+		}
+	}
+	m.versions.Apply(edit)
+
+	for _, table := range edit.RemovedTables {
+		m.unregister(table.Name, table.Level)
+	}
+	for _, table := range edit.AddedTables {
+		m.register(m.pending[table.Name])
+		delete(m.pending, table.Name)
+	}
+	for _, move := range edit.MovedTables {
+		if sstable := m.unregister(move.Name, move.FromLevel); sstable != nil {
+			sstable.Level = move.ToLevel
+			m.register(sstable)
+		}
+	}
+
+	return nil
+}
+
+// discard drops a table created with NewSSTable that will never become live.
+func (m *SSTableManager) discard(sstable *SSTable) {
+	delete(m.pending, sstable.Name)
+	if err := os.Remove(sstable.Path); err != nil && !os.IsNotExist(err) {
+		internal.Logger.Warn("Failed to remove discarded SSTable", "sstable", sstable.Path, "err", err)
+	}
+}
+
+// LastSequence returns the sequence number of the newest write stored in an
+// SSTable.
+func (m *SSTableManager) LastSequence() uint64 {
+	return m.versions.LastSequence
+}
+
+// LogNumber returns the oldest WAL segment still needed for recovery.
+func (m *SSTableManager) LogNumber() uint64 {
+	return m.versions.LogNumber
+}
+
+// Load recovers the set of live SSTables, e.g. after a restart, and starts a
+// fresh MANIFEST holding it. Tables are recovered from the MANIFEST when there
+// is one; files it does not list were left by an interrupted flush or
+// compaction and are removed. Older data directories without a MANIFEST are
+// recovered from the directory listing instead.
+func (m *SSTableManager) Load() error {
+	versions, number, err := ReadManifest(m.outputDir)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to read MANIFEST: %w", err)
+	}
+
+	if versions != nil {
+		err = m.loadFromManifest(versions)
+	} else {
+		err = m.loadFromDir()
+	}
+	if err != nil {
+		return err
+	}
+
+	m.manifest, err = CreateManifest(m.outputDir, number+1, m.versions)
+	return err
+}
+
+func (m *SSTableManager) loadFromManifest(versions *VersionSet) error {
+	for _, table := range versions.Tables {
+		sstable, err := m.loadSSTable(table.Name, table.Level, table.SeqNumber)
+		if err != nil {
+			return fmt.Errorf("failed to load sstable %s: %w", m.FilePath(table.Name, table.Level), err)
+		}
+		sstable.MinKey = table.MinKey
+		sstable.MaxKey = table.MaxKey
+		sstable.Size = table.Size
+		m.register(sstable)
+	}
+
+	m.versions = versions
+	m.seqNumber = max(m.seqNumber, versions.NextFileNumber-1)
+
+	return m.walkTableFiles(func(name string, level int, seqNumber int) error {
+		// Numbers still have to move past orphans, their files may be open
+		m.seqNumber = max(m.seqNumber, seqNumber)
+		if table, ok := versions.Tables[name]; ok && table.Level == level {
+			return nil
+		}
+		internal.Logger.Info("Removing SSTable missing from MANIFEST", "sstable", m.FilePath(name, level))
+		return os.Remove(m.FilePath(name, level))
+	})
+}
+
+func (m *SSTableManager) loadFromDir() error {
+	err := m.walkTableFiles(func(name string, level int, seqNumber int) error {
+		sstable, err := m.loadSSTable(name, level, seqNumber)
+		if err != nil {
+			return fmt.Errorf("failed to load sstable %s: %w", m.FilePath(name, level), err)
+		}
+
+		if err := m.loadKeyRange(sstable); err != nil {
+			return fmt.Errorf("failed to read key range of sstable %s: %w", sstable.Path, err)
+		}
+
+		m.register(sstable)
+		m.versions.Tables[name] = sstable.Metadata()
+		m.seqNumber = max(m.seqNumber, seqNumber)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.versions.NextFileNumber = m.seqNumber + 1
+	return nil
+}
+
+// loadKeyRange sets the key range of s from its contents. The first key opens
+// the first block; the last one has to be read from the last block.
+func (m *SSTableManager) loadKeyRange(s *SSTable) error {
+	if len(s.indexKeys) == 0 {
+		return nil
+	}
+	s.MinKey = string(s.indexKeys[0])
+
+	iterator, err := m.NewIteratorFrom(s, string(s.indexKeys[len(s.indexKeys)-1]))
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for {
+		record, err := iterator.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.MaxKey = string(record.Key)
+	}
+}
+
+// walkTableFiles calls fn for every table file under the output directory.
+func (m *SSTableManager) walkTableFiles(fn func(name string, level int, seqNumber int) error) error {
+	levelDirs, err := os.ReadDir(m.outputDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, levelDir := range levelDirs {
+		levelStr, ok := strings.CutPrefix(levelDir.Name(), "level_")
+		if !levelDir.IsDir() || !ok {
+			continue
+		}
+		level, err := strconv.Atoi(levelStr)
+		if err != nil {
+			continue
+		}
+
+		files, err := os.ReadDir(path.Join(m.outputDir, levelDir.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			name, ok := strings.CutSuffix(file.Name(), ".bin")
+			if file.IsDir() || !ok {
+				continue
+			}
+			seqNumber, err := strconv.Atoi(name)
+			if err != nil {
+				continue
+			}
+
+			if err := fn(name, level, seqNumber); err != nil {
+				return err
+			}
+		}
 	}
 
+	return nil
+}
+
+func (m *SSTableManager) loadSSTable(name string, level int, seqNumber int) (*SSTable, error) {
+	filePath := m.FilePath(name, level)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
-	metadataOffset := m.serializer.MetadataSize(*s.BloomFilter, *s.SparseIndex)
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-	offset, exists := s.SparseIndex.Get(algo.SparseIndexKey(key))
-	if !exists {
-		return nil, fmt.Errorf("key not found: %s", key)
+	// The header size depends on the format version, so it is measured
+	reader := &countingReader{reader: bufio.NewReader(file)}
+	metadata, err := m.deserializer.DeserializeMetadata(reader)
+	if err != nil {
+		return nil, err
 	}
 
-	reader := bufio.NewReader(file)
-	// Advance the reader to the record's offset
-	_, err = reader.Discard(metadataOffset + int(offset))
+	return &SSTable{
+		Level:       level,
+		Name:        name,
+		Path:        filePath,
+		BloomFilter: &metadata.BloomFilter,
+		SparseIndex: &metadata.SparseIndex,
+		CreatedAt:   info.ModTime(),
+		Size:        info.Size(),
+		seqNumber:   seqNumber,
+		version:     metadata.Version,
+		dataOffset:  reader.count,
+		indexKeys:   metadata.SparseIndex.SortedKeys(),
+	}, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int
+}
 
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += n
+	return n, err
+}
+
+// Read returns the newest version of key held by s.
+func (m *SSTableManager) Read(s *SSTable, key string) (*DBRecord, error) {
+	return m.ReadAt(s, key, math.MaxUint64)
+}
+
+// ReadAt returns the newest version of key held by s that was written at or
+// before seqNumber. Only the block that may hold the key is read; the
+// versions of a key are stored newest first and never split across blocks.
+func (m *SSTableManager) ReadAt(s *SSTable, key string, seqNumber uint64) (*DBRecord, error) {
+	start, end, ok := s.block(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	file, err := os.Open(s.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	deserialized, err := m.deserializer.DeserializeRecord(reader)
+	defer file.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, int64(s.dataOffset)+start, end-start))
 
-	return deserialized, err
+	for {
+		record, err := m.deserializer.DeserializeRecord(reader, s.version)
+		if err == io.EOF || (err == nil && string(record.Key) > key) {
+			return nil, fmt.Errorf("%w: %s at sequence %d", ErrKeyNotFound, key, seqNumber)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if string(record.Key) == key && record.SeqNumber <= seqNumber {
+			return record, nil
+		}
+	}
 }
 
+// Flush writes every version held by memtable to s.
 func (m *SSTableManager) Flush(s *SSTable, memtable MemTable) error {
+	records, err := collectRecords(NewMemTableIterator(memtable))
+	if err != nil {
+		return err
+	}
+
+	return m.WriteRecords(s, records)
+}
+
+// WriteRecords writes records, sorted by key and the versions of a key newest
+// first, to the file of s and fills in its bloom filter, index and key range.
+// A new block is started at the first key after the current block reached
+// the block size, so all versions of a key share a block. Unless its size is
+// fixed, the bloom filter is sized for the keys written.
+func (m *SSTableManager) WriteRecords(s *SSTable, records []DBRecord) error {
 	dir := path.Dir(s.Path)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
@@ -116,24 +470,36 @@ func (m *SSTableManager) Flush(s *SSTable, memtable MemTable) error {
 
 	defer file.Close()
 
-	records := []DBRecord{}
-	byteOffset := 0
+	if m.bloomFilterSize <= 0 {
+		keys := 0
+		for i, record := range records {
+			if i == 0 || records[i-1].Key != record.Key {
+				keys++
+			}
+		}
+		s.BloomFilter = algo.NewBloomFilterForKeys(keys, m.bloomBitsPerKey)
+	}
 
-	for kv := range memtable.Iterator() {
-		records = append(records, DBRecord{
-			Key:       DBRecordKey(kv.Key),
-			Value:     kv.Value,
-			Timestamp: DBRecordTimestamp(kv.Metadata.Timestamp.Unix()),
-			Tombstone: false,
-		})
+	byteOffset := 0
+	blockOffset := 0
 
-		s.BloomFilter.Add(kv.Key)
-		s.SparseIndex.Update(
-			algo.SparseIndexKey(kv.Key),
-			algo.SparseIndexOffset(byteOffset),
-		)
+	for i, record := range records {
+		if i == 0 {
+			s.MinKey = string(record.Key)
+		}
+		s.MaxKey = string(record.Key)
+
+		s.BloomFilter.Add(string(record.Key))
+		newKey := i == 0 || records[i-1].Key != record.Key
+		if i == 0 || (newKey && byteOffset-blockOffset >= m.blockSize) {
+			s.SparseIndex.Update(
+				algo.SparseIndexKey(record.Key),
+				algo.SparseIndexOffset(byteOffset),
+			)
+			blockOffset = byteOffset
+		}
 
-		byteOffset += m.serializer.RecordSize(DBRecordKey(kv.Key), kv.Value)
+		byteOffset += m.serializer.RecordSize(record.Key, record.Value)
 	}
 
 	serialized, err := m.serializer.Serialize(
@@ -146,30 +512,138 @@ func (m *SSTableManager) Flush(s *SSTable, memtable MemTable) error {
 		return err
 	}
 
-	_, err = file.Write(serialized)
+	if _, err := file.Write(serialized); err != nil {
+		return err
+	}
+	s.Size = int64(len(serialized))
+	s.version = SSTABLE_FORMAT_VERSION
+	s.dataOffset = m.serializer.MetadataSize(*s.BloomFilter, *s.SparseIndex)
+	s.indexKeys = s.SparseIndex.SortedKeys()
+
+	// The WAL segments or input tables covered by this table are released
+	// once it is live, so the table has to be durable first
+	if err := file.Sync(); err != nil {
+		return err
+	}
 
-	return err
+	return syncDir(dir)
 }
 
-func (m *SSTableManager) FindByKey(key string) *SSTable {
-	// Find most recent SSTable from level 0
-	// TODO: Support multiple levels
-	level := 0
-	var sstables []*SSTable
+// seek returns the offset, relative to the data block, of the block that may
+// hold start: the last one whose first key is not above start. Reading from
+// there on reaches start.
+func (s *SSTable) seek(start string) algo.SparseIndexOffset {
+	i := sort.Search(len(s.indexKeys), func(i int) bool {
+		return string(s.indexKeys[i]) > start
+	})
+	if i == 0 {
+		return 0
+	}
+	offset, _ := s.SparseIndex.Get(s.indexKeys[i-1])
+	return offset
+}
+
+// block returns the byte range, relative to the data block, of the block that
+// may hold key. It reports false when key sorts before the first block.
+func (s *SSTable) block(key string) (start, end int64, ok bool) {
+	i := sort.Search(len(s.indexKeys), func(i int) bool {
+		return string(s.indexKeys[i]) > key
+	})
+	if i == 0 {
+		return 0, 0, false
+	}
+
+	offset, _ := s.SparseIndex.Get(s.indexKeys[i-1])
+	start = int64(offset)
+	end = s.Size - int64(s.dataOffset)
+	if i < len(s.indexKeys) {
+		offset, _ = s.SparseIndex.Get(s.indexKeys[i])
+		end = int64(offset)
+	}
+	return start, end, true
+}
+
+// Overlaps reports whether the key range of s intersects [minKey, maxKey].
+func (s *SSTable) Overlaps(minKey, maxKey string) bool {
+	return s.MinKey <= maxKey && minKey <= s.MaxKey
+}
+
+// candidates returns the tables that may hold key, newest first: level 0
+// tables in reverse flush order, then at most one table of each deeper level.
+// Tables whose key range or bloom filter rules the key out are skipped.
+func (m *SSTableManager) candidates(key string) []*SSTable {
+	var candidates []*SSTable
+
+	for _, sstable := range slices.Backward(m.sstables[0]) {
+		if sstable.Overlaps(key, key) && sstable.BloomFilter.Contains(key) {
+			candidates = append(candidates, sstable)
+		}
+	}
+
+	for level := 1; level <= m.MaxLevel(); level++ {
+		sstables := m.sstables[level]
+		i := sort.Search(len(sstables), func(i int) bool {
+			return sstables[i].MaxKey >= key
+		})
+		if i < len(sstables) && sstables[i].Overlaps(key, key) && sstables[i].BloomFilter.Contains(key) {
+			candidates = append(candidates, sstables[i])
+		}
+	}
 
-	for _, sstable := range m.sstables[level] {
-		if sstable.BloomFilter.Contains(key) {
-			sstables = append(sstables, sstable)
+	return candidates
+}
+
+// Find returns the newest record of key, which may be a tombstone, and the
+// table holding it. It returns a nil record when no table holds the key.
+func (m *SSTableManager) Find(key string) (*DBRecord, *SSTable, error) {
+	return m.FindAt(key, math.MaxUint64)
+}
+
+// FindAt is Find as of seqNumber: versions written after it are ignored.
+// Tables that only matched by a bloom filter false positive, or that only
+// hold newer versions, are passed over.
+func (m *SSTableManager) FindAt(key string, seqNumber uint64) (*DBRecord, *SSTable, error) {
+	for _, sstable := range m.candidates(key) {
+		record, err := m.ReadAt(sstable, key, seqNumber)
+		if errors.Is(err, ErrKeyNotFound) {
+			internal.Logger.Debug("No visible version in sstable", "sstable", sstable.Path, "key", key, "seqNumber", seqNumber)
+			continue
+		}
+		if err != nil {
+			return nil, sstable, err
 		}
+		return record, sstable, nil
 	}
 
-	if len(sstables) == 0 {
+	return nil, nil, nil
+}
+
+// FindByKey returns the newest table holding key, or nil.
+func (m *SSTableManager) FindByKey(key string) *SSTable {
+	record, sstable, err := m.Find(key)
+	if err != nil || record == nil {
 		return nil
 	}
+	return sstable
+}
 
-	sort.Slice(sstables, func(i, j int) bool {
-		return sstables[i].seqNumber > sstables[j].seqNumber
-	})
+// Close closes the MANIFEST.
+func (m *SSTableManager) Close() error {
+	if m.manifest == nil {
+		return nil
+	}
+	err := m.manifest.Close()
+	m.manifest = nil
+	return err
+}
 
-	return sstables[0]
+// MaxLevel returns the deepest level holding tables.
+func (m *SSTableManager) MaxLevel() int {
+	maxLevel := 0
+	for level, sstables := range m.sstables {
+		if len(sstables) > 0 {
+			maxLevel = max(maxLevel, level)
+		}
+	}
+	return maxLevel
 }
@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -23,6 +24,7 @@ type SSTableSerializer interface {
 }
 
 type Deserialized struct {
+	Version     uint32
 	BloomFilter algo.BloomFilter
 	SparseIndex algo.SparseIndex
 	Records     []DBRecord
@@ -30,7 +32,8 @@ type Deserialized struct {
 
 type SSTableDeserializer interface {
 	Deserialize(io.Reader) (*Deserialized, error)
-	DeserializeRecord(io.Reader) (*DBRecord, error)
+	DeserializeMetadata(io.Reader) (*Deserialized, error)
+	DeserializeRecord(io.Reader, uint32) (*DBRecord, error)
 }
 
 type StandardSSTableSerializer struct{}
@@ -49,7 +52,30 @@ type DBRecordKeySize int32
 type DBRecordValueSize int32
 type DBRecordTimestampSize int64
 type DBRecordTombstoneSize int32
-
+type DBRecordSeqNumberSize int32
+
+// SSTABLE_MAGIC opens every SSTable written with a format version. Its high
+// bit is set, so read as the leading bloom filter size of a version 1 table,
+// which had no version header, it is an invalid negative size.
+const SSTABLE_MAGIC uint32 = 0xE5B7AB1E
+
+// Version 1 tables indexed every key and their records had no sequence
+// number; version 2 tables are split into blocks of about the configured
+// block size, index one key per block and store sequence numbers. Version 3
+// encodes the sparse index in binary, see algo.SparseIndex.Bytes, and version
+// 4 the bloom filter, see algo.BloomFilter.Bytes.
+const SSTABLE_FORMAT_VERSION uint32 = 4
+
+// Records of tables from this version on end with a sequence number. Records
+// of older tables read as sequence number 0, older than any write since.
+const SSTABLE_SEQ_NUMBER_VERSION uint32 = 2
+
+// Versions up to these store the sparse index and the bloom filter as text.
+const SSTABLE_TEXT_INDEX_VERSION uint32 = 2
+const SSTABLE_TEXT_BLOOM_FILTER_VERSION uint32 = 3
+
+const SSTABLE_MAGIC_BYTES = 4
+const SSTABLE_VERSION_BYTES = 4
 const BLOOM_FILTER_SIZE_BYTES = 4
 const SPARSE_INDEX_SIZE_BYTES = 4
 const DB_RECORD_KEY_SIZE_BYTES = 4
@@ -58,6 +84,10 @@ const DB_RECORD_TIMESTAMP_SIZE_BYTES = 8
 const DB_RECORD_TIMESTAMP_BYTES = 8
 const DB_RECORD_TOMBSTONE_SIZE_BYTES = 4
 const DB_RECORD_TOMBSTONE_BYTES = 1
+const DB_RECORD_SEQ_NUMBER_SIZE_BYTES = 4
+const DB_RECORD_SEQ_NUMBER_BYTES = 8
+
+var ErrUnsupportedSSTableVersion = errors.New("unsupported sstable format version")
 
 func (s *StandardSSTableSerializer) Serialize(
 	bloomFilter algo.BloomFilter,
@@ -71,11 +101,12 @@ func (s *StandardSSTableSerializer) Serialize(
 
 	for _, node := range ser {
 		serializedNode := fmt.Sprintf(
-			"%d %s %d %s %d %d %d %d",
+			"%d %s %d %s %d %d %d %d %d %d",
 			len([]byte(node.Key)), node.Key,
 			len([]byte(node.Value)), node.Value,
 			8, node.Timestamp,
-			1, boolToInt(bool(node.Tombstone)))
+			1, boolToInt(bool(node.Tombstone)),
+			8, node.SeqNumber)
 
 		dataBlock = append(dataBlock, serializedNode)
 	}
@@ -91,17 +122,21 @@ func (s *BinarySSTableSerializer) RecordSize(key DBRecordKey, value DBRecordValu
 		DB_RECORD_TIMESTAMP_SIZE_BYTES +
 		DB_RECORD_TIMESTAMP_BYTES +
 		DB_RECORD_TOMBSTONE_SIZE_BYTES +
-		DB_RECORD_TOMBSTONE_BYTES
+		DB_RECORD_TOMBSTONE_BYTES +
+		DB_RECORD_SEQ_NUMBER_SIZE_BYTES +
+		DB_RECORD_SEQ_NUMBER_BYTES
 }
 
 func (s *BinarySSTableSerializer) MetadataSize(
 	bloomFilter algo.BloomFilter,
 	sparseIndex algo.SparseIndex,
 ) int {
-	return BLOOM_FILTER_SIZE_BYTES +
-		len([]byte(bloomFilter.String())) +
+	return SSTABLE_MAGIC_BYTES +
+		SSTABLE_VERSION_BYTES +
+		BLOOM_FILTER_SIZE_BYTES +
+		len(bloomFilter.Bytes()) +
 		SPARSE_INDEX_SIZE_BYTES +
-		len([]byte(sparseIndex.String()))
+		len(sparseIndex.Bytes())
 }
 
 func (s *BinarySSTableSerializer) Serialize(
@@ -111,21 +146,27 @@ func (s *BinarySSTableSerializer) Serialize(
 ) (SSTableFile, error) {
 	buf := new(bytes.Buffer)
 
-	bloomFilterBits := bloomFilter.String()
+	bloomFilterBits := bloomFilter.Bytes()
 	bloomFilterBitsSize := BloomFilterSize(len(bloomFilterBits))
-	sparseIndexStr := sparseIndex.String()
-	sparseIndexSize := SparseIndexSize(len(sparseIndexStr))
+	sparseIndexBytes := sparseIndex.Bytes()
+	sparseIndexSize := SparseIndexSize(len(sparseIndexBytes))
 
+	if err := binary.Write(buf, BYTES_ORDER, SSTABLE_MAGIC); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, BYTES_ORDER, SSTABLE_FORMAT_VERSION); err != nil {
+		return nil, err
+	}
 	if err := binary.Write(buf, BYTES_ORDER, bloomFilterBitsSize); err != nil {
 		return nil, err
 	}
-	if _, err := buf.WriteString(bloomFilterBits); err != nil {
+	if _, err := buf.Write(bloomFilterBits); err != nil {
 		return nil, err
 	}
 	if err := binary.Write(buf, BYTES_ORDER, sparseIndexSize); err != nil {
 		return nil, err
 	}
-	if _, err := buf.WriteString(sparseIndexStr); err != nil {
+	if _, err := buf.Write(sparseIndexBytes); err != nil {
 		return nil, err
 	}
 
@@ -138,6 +179,8 @@ func (s *BinarySSTableSerializer) Serialize(
 		timestampSize := DBRecordTimestampSize(8)
 		tombstone := record.Tombstone
 		tombstoneSize := DBRecordTombstoneSize(1)
+		seqNumber := record.SeqNumber
+		seqNumberSize := DBRecordSeqNumberSize(8)
 
 		if err := binary.Write(buf, BYTES_ORDER, keySize); err != nil {
 			return nil, err
@@ -163,18 +206,28 @@ func (s *BinarySSTableSerializer) Serialize(
 		if err := binary.Write(buf, BYTES_ORDER, tombstone); err != nil {
 			return nil, err
 		}
+		if err := binary.Write(buf, BYTES_ORDER, seqNumberSize); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, BYTES_ORDER, seqNumber); err != nil {
+			return nil, err
+		}
 	}
 
 	return buf.Bytes(), nil
 }
 
-func (d *BinarySSTableDeserializer) DeserializeRecord(reader io.Reader) (*DBRecord, error) {
+// DeserializeRecord reads a record laid out as in tables of the given format
+// version.
+func (d *BinarySSTableDeserializer) DeserializeRecord(reader io.Reader, version uint32) (*DBRecord, error) {
 	var keySize DBRecordKeySize
 	var valueSize DBRecordValueSize
 	var timestampSize DBRecordTimestampSize
 	var timestamp DBRecordTimestamp
 	var tombstoneSize DBRecordTombstoneSize
 	var tombstone DBRecordTombstone
+	var seqNumberSize DBRecordSeqNumberSize
+	var seqNumber uint64
 
 	if err := binary.Read(reader, BYTES_ORDER, &keySize); err != nil {
 		return nil, err
@@ -211,25 +264,57 @@ func (d *BinarySSTableDeserializer) DeserializeRecord(reader io.Reader) (*DBReco
 	if err := binary.Read(reader, BYTES_ORDER, &tombstone); err != nil {
 		return nil, err
 	}
+	if version >= SSTABLE_SEQ_NUMBER_VERSION {
+		if err := binary.Read(reader, BYTES_ORDER, &seqNumberSize); err != nil {
+			return nil, err
+		}
+		if seqNumberSize < 0 {
+			return nil, fmt.Errorf("invalid sequence number size: %d", seqNumberSize)
+		}
+		if err := binary.Read(reader, BYTES_ORDER, &seqNumber); err != nil {
+			return nil, err
+		}
+	}
 
 	return &DBRecord{
 		Key:       DBRecordKey(key),
 		Value:     DBRecordValue(value),
 		Timestamp: DBRecordTimestamp(timestamp),
 		Tombstone: DBRecordTombstone(tombstone),
+		SeqNumber: seqNumber,
 	}, nil
 }
 
-// TODO: VALIDATE
-func (d *BinarySSTableDeserializer) Deserialize(reader io.Reader) (*Deserialized, error) {
+// DeserializeMetadata reads only the header of an SSTable: its format
+// version, bloom filter and sparse index. The reader is left at the start of
+// the data block. Tables of older versions are still read, including version
+// 1 tables, which start right with the bloom filter.
+func (d *BinarySSTableDeserializer) DeserializeMetadata(reader io.Reader) (*Deserialized, error) {
+	var magic uint32
+	var version uint32
 	var bloomFilterBitsSize BloomFilterSize
 	var bloomFilterBits []byte
 	var sparseIndexSize SparseIndexSize
 	var sparseIndex []byte
 
-	if err := binary.Read(reader, BYTES_ORDER, &bloomFilterBitsSize); err != nil {
+	if err := binary.Read(reader, BYTES_ORDER, &magic); err != nil {
 		return nil, err
 	}
+	if magic == SSTABLE_MAGIC {
+		if err := binary.Read(reader, BYTES_ORDER, &version); err != nil {
+			return nil, err
+		}
+		// Version 1 tables have no header
+		if version < 2 || version > SSTABLE_FORMAT_VERSION {
+			return nil, fmt.Errorf("%w: %d", ErrUnsupportedSSTableVersion, version)
+		}
+		if err := binary.Read(reader, BYTES_ORDER, &bloomFilterBitsSize); err != nil {
+			return nil, err
+		}
+	} else {
+		version = 1
+		bloomFilterBitsSize = BloomFilterSize(magic)
+	}
 	if bloomFilterBitsSize <= 0 {
 		return nil, fmt.Errorf("invalid bloom filter size: %d", bloomFilterBitsSize)
 	}
@@ -249,67 +334,51 @@ func (d *BinarySSTableDeserializer) Deserialize(reader io.Reader) (*Deserialized
 		return nil, err
 	}
 
-	records := []DBRecord{}
-
-	for {
-		var keySize DBRecordKeySize
-		var valueSize DBRecordValueSize
-		var timestampSize DBRecordTimestampSize
-		var timestamp DBRecordTimestamp
-		var tombstoneSize DBRecordTombstoneSize
-		var tombstone DBRecordTombstone
-
-		if err := binary.Read(reader, BYTES_ORDER, &keySize); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		key := make([]byte, keySize)
-		if err := binary.Read(reader, BYTES_ORDER, key); err != nil {
+	filter := algo.NewBloomFilterFromString(string(bloomFilterBits))
+	if version > SSTABLE_TEXT_BLOOM_FILTER_VERSION {
+		var err error
+		if filter, err = algo.NewBloomFilterFromBytes(bloomFilterBits); err != nil {
 			return nil, err
 		}
-		if err := binary.Read(reader, BYTES_ORDER, &valueSize); err != nil {
-			return nil, err
-		}
-		if valueSize < 0 {
-			return nil, fmt.Errorf("invalid value size: %d", valueSize)
-		}
-		value := make([]byte, valueSize)
-		if err := binary.Read(reader, BYTES_ORDER, value); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(reader, BYTES_ORDER, &timestampSize); err != nil {
-			return nil, err
-		}
-		if timestampSize < 0 {
-			return nil, fmt.Errorf("invalid timestamp size: %d", timestampSize)
-		}
-		if err := binary.Read(reader, BYTES_ORDER, &timestamp); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(reader, BYTES_ORDER, &tombstoneSize); err != nil {
+	}
+
+	index := algo.NewSparseIndexFromString(string(sparseIndex))
+	if version > SSTABLE_TEXT_INDEX_VERSION {
+		var err error
+		if index, err = algo.NewSparseIndexFromBytes(sparseIndex); err != nil {
 			return nil, err
 		}
-		if tombstoneSize < 0 {
-			return nil, fmt.Errorf("invalid tombstone size: %d", tombstoneSize)
+	}
+
+	return &Deserialized{
+		Version:     version,
+		BloomFilter: *filter,
+		SparseIndex: *index,
+	}, nil
+}
+
+// TODO: VALIDATE
+func (d *BinarySSTableDeserializer) Deserialize(reader io.Reader) (*Deserialized, error) {
+	deserialized, err := d.DeserializeMetadata(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []DBRecord{}
+
+	for {
+		record, err := d.DeserializeRecord(reader, deserialized.Version)
+		if err == io.EOF {
+			break
 		}
-		if err := binary.Read(reader, BYTES_ORDER, &tombstone); err != nil {
+		if err != nil {
 			return nil, err
 		}
 
-		records = append(records, DBRecord{
-			Key:       DBRecordKey(key),
-			Value:     DBRecordValue(value),
-			Timestamp: DBRecordTimestamp(timestamp),
-			Tombstone: DBRecordTombstone(tombstone),
-		})
-
+		records = append(records, *record)
 	}
 
-	return &Deserialized{
-		BloomFilter: *algo.NewBloomFilterFromString(string(bloomFilterBits)),
-		SparseIndex: *algo.NewSparseIndexFromString(string(sparseIndex)),
-		Records:     records,
-	}, nil
+	deserialized.Records = records
+
+	return deserialized, nil
 }
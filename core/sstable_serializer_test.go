@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 
 	"github.com/ogioldat/ttrunksdb/algo"
@@ -244,6 +245,7 @@ func TestBinarySerializerWithSpecialCharacters(t *testing.T) {
 		Value:     DBRecordValue("value with\nnewlines\tand\x00null bytes"),
 		Timestamp: DBRecordTimestamp(1751374012),
 		Tombstone: DBRecordTombstone(false),
+		SeqNumber: 42,
 	}
 
 	// Serialize
@@ -270,6 +272,7 @@ func TestBinarySerializerWithSpecialCharacters(t *testing.T) {
 	assert.Equal(t, record.Value, result.Value, "Special characters in value should survive round trip")
 	assert.Equal(t, record.Timestamp, result.Timestamp, "Timestamp should match")
 	assert.Equal(t, record.Tombstone, result.Tombstone, "Tombstone should match")
+	assert.Equal(t, record.SeqNumber, result.SeqNumber, "Sequence number should match")
 }
 
 func TestBinarySerializerDataSize(t *testing.T) {
@@ -295,9 +298,119 @@ func TestBinarySerializerDataSize(t *testing.T) {
 
 	// Calculate expected size:
 	// key(4) + keySize(4) + value(4) + valueSize(4) + timestamp(8) + timestampSize(4) + tombstone(1) + tombstoneSize(4)
+	// + seqNumber(8) + seqNumberSize(4)
 	expectedSize := serializer.MetadataSize(*sstable.BloomFilter, *sstable.SparseIndex) + serializer.RecordSize(
 		DBRecordKey("test"),
 		DBRecordValue("data"),
 	)
 	assert.Equal(t, expectedSize, len(result), "Serialized data should have expected size")
 }
+
+// textHeaderSSTable encodes records the way tables of versions 1 to 3 were,
+// with the bloom filter, and up to version 2 the sparse index, as text, and
+// in version 1 without sequence numbers.
+func textHeaderSSTable(t *testing.T, version uint32, bloomFilter algo.BloomFilter, sparseIndex algo.SparseIndex, records []DBRecord) []byte {
+	serializer := &BinarySSTableSerializer{}
+	serialized, err := serializer.Serialize(bloomFilter, sparseIndex, records)
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	if version > 1 {
+		binary.Write(buf, BYTES_ORDER, SSTABLE_MAGIC)
+		binary.Write(buf, BYTES_ORDER, version)
+	}
+	binary.Write(buf, BYTES_ORDER, BloomFilterSize(len(bloomFilter.String())))
+	buf.WriteString(bloomFilter.String())
+	encodedIndex := []byte(sparseIndex.String())
+	if version > SSTABLE_TEXT_INDEX_VERSION {
+		encodedIndex = sparseIndex.Bytes()
+	}
+	binary.Write(buf, BYTES_ORDER, SparseIndexSize(len(encodedIndex)))
+	buf.Write(encodedIndex)
+	if version >= SSTABLE_SEQ_NUMBER_VERSION {
+		buf.Write(serialized[serializer.MetadataSize(bloomFilter, sparseIndex):])
+		return buf.Bytes()
+	}
+
+	for _, record := range records {
+		binary.Write(buf, BYTES_ORDER, DBRecordKeySize(len(record.Key)))
+		buf.WriteString(string(record.Key))
+		binary.Write(buf, BYTES_ORDER, DBRecordValueSize(len(record.Value)))
+		buf.Write(record.Value)
+		binary.Write(buf, BYTES_ORDER, DBRecordTimestampSize(8))
+		binary.Write(buf, BYTES_ORDER, record.Timestamp)
+		binary.Write(buf, BYTES_ORDER, DBRecordTombstoneSize(1))
+		binary.Write(buf, BYTES_ORDER, record.Tombstone)
+	}
+	return buf.Bytes()
+}
+
+func TestBinaryDeserializerFormatVersions(t *testing.T) {
+	serializer := &BinarySSTableSerializer{}
+	deserializer := &BinarySSTableDeserializer{}
+
+	records := []DBRecord{
+		{Key: DBRecordKey("a"), Value: DBRecordValue("1"), SeqNumber: 1},
+		{Key: DBRecordKey("b"), Value: DBRecordValue("2"), SeqNumber: 2},
+	}
+	bloomFilter := algo.NewBloomFilterForKeys(len(records), 10)
+	bloomFilter.Add("a")
+	bloomFilter.Add("b")
+	sparseIndex := algo.NewSparseIndex()
+	sparseIndex.Update("a", 0)
+	serialized, err := serializer.Serialize(*bloomFilter, *sparseIndex, records)
+	assert.NoError(t, err)
+
+	deserialized, err := deserializer.Deserialize(bytes.NewReader(serialized))
+	assert.NoError(t, err)
+	assert.Equal(t, SSTABLE_FORMAT_VERSION, deserialized.Version)
+	assert.Equal(t, records, deserialized.Records)
+	assert.Equal(t, sparseIndex.Index, deserialized.SparseIndex.Index)
+
+	assert.Equal(t, bloomFilter.Bytes(), deserialized.BloomFilter.Bytes())
+	assert.True(t, deserialized.BloomFilter.Contains("b"))
+
+	for _, version := range []uint32{1, 2, 3} {
+		legacy := textHeaderSSTable(t, version, *bloomFilter, *sparseIndex, records)
+		deserialized, err = deserializer.Deserialize(bytes.NewReader(legacy))
+		assert.NoError(t, err)
+		assert.Equal(t, version, deserialized.Version)
+		if version < SSTABLE_SEQ_NUMBER_VERSION {
+			// Records written before sequence numbers read as the oldest
+			for i, record := range deserialized.Records {
+				assert.Zero(t, record.SeqNumber)
+				deserialized.Records[i].SeqNumber = records[i].SeqNumber
+			}
+		}
+		assert.Equal(t, records, deserialized.Records)
+		assert.Equal(t, sparseIndex.Index, deserialized.SparseIndex.Index)
+		assert.Equal(t, bloomFilter.String(), deserialized.BloomFilter.String())
+		assert.Equal(t, algo.LEGACY_BLOOM_HASHES, deserialized.BloomFilter.Hashes())
+	}
+
+	unsupported := bytes.Clone(serialized)
+	BYTES_ORDER.PutUint32(unsupported[SSTABLE_MAGIC_BYTES:], SSTABLE_FORMAT_VERSION+1)
+	_, err = deserializer.Deserialize(bytes.NewReader(unsupported))
+	assert.ErrorIs(t, err, ErrUnsupportedSSTableVersion)
+}
+
+func TestBinarySerializerKeysWithSeparators(t *testing.T) {
+	serializer := &BinarySSTableSerializer{}
+	deserializer := &BinarySSTableDeserializer{}
+
+	records := []DBRecord{
+		{Key: DBRecordKey("https://example.com/a?b=1,2"), Value: DBRecordValue("url")},
+		{Key: DBRecordKey("tenant:user"), Value: DBRecordValue("composite")},
+	}
+	sparseIndex := algo.NewSparseIndex()
+	sparseIndex.Update("https://example.com/a?b=1,2", 0)
+	sparseIndex.Update("tenant:user", 100)
+
+	serialized, err := serializer.Serialize(*algo.NewBloomFilterFromString("0110"), *sparseIndex, records)
+	assert.NoError(t, err)
+
+	deserialized, err := deserializer.Deserialize(bytes.NewReader(serialized))
+	assert.NoError(t, err)
+	assert.Equal(t, sparseIndex.Index, deserialized.SparseIndex.Index)
+	assert.Equal(t, records[1].Key, deserialized.Records[1].Key)
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -76,3 +77,245 @@ func TestSSTableBloomFilter(t *testing.T) {
 	assert.True(t, sstable.BloomFilter.Contains("test_key"))
 	assert.False(t, sstable.BloomFilter.Contains("non_existent"))
 }
+
+func TestSSTableManagerLoad(t *testing.T) {
+	tempDir := t.TempDir()
+	cfg := &LSMTStorageConfig{outputDir: tempDir, sstableBloomFilterSize: 1000}
+	manager := NewSSTableManager(cfg)
+
+	first, _ := NewFromKVPairs("a:old,b:2")
+	second, _ := NewFromKVPairs("a:new,c:3")
+	assert.NoError(t, manager.Flush(manager.AddSSTable(cfg), first))
+	assert.NoError(t, manager.Flush(manager.AddSSTable(cfg), second))
+
+	loaded := NewSSTableManager(cfg)
+	assert.NoError(t, loaded.Load())
+
+	assert.Len(t, loaded.sstables[0], 2)
+	assert.Equal(t, "0001", loaded.sstables[0][0].Name)
+	assert.Equal(t, "0002", loaded.sstables[0][1].Name)
+
+	sstable := loaded.FindByKey("a")
+	assert.NotNil(t, sstable)
+	assert.Equal(t, "0002", sstable.Name)
+
+	record, err := loaded.Read(sstable, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, DBRecordValue("new"), record.Value)
+
+	// New tables continue after the highest existing number
+	assert.Equal(t, "0003", loaded.AddSSTable(cfg).Name)
+}
+
+func TestSSTableManagerLoadEmpty(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+	manager := NewSSTableManager(cfg)
+
+	assert.NoError(t, manager.Load())
+	assert.Empty(t, manager.sstables)
+}
+
+func TestSSTableManagerLoadFromManifest(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000}
+	manager := NewSSTableManager(cfg)
+	assert.NoError(t, manager.Load())
+
+	memtable, _ := NewFromKVPairs("a:1,b:2")
+	live := manager.NewSSTable(cfg, 0)
+	assert.NoError(t, manager.Flush(live, memtable))
+	assert.NoError(t, manager.LogAndApply(&VersionEdit{
+		AddedTables:  []TableMetadata{live.Metadata()},
+		LastSequence: 2,
+	}))
+
+	// A table flushed right before a crash never made it into the MANIFEST
+	orphan := manager.NewSSTable(cfg, 0)
+	assert.NoError(t, manager.Flush(orphan, memtable))
+
+	loaded := NewSSTableManager(cfg)
+	assert.NoError(t, loaded.Load())
+
+	assert.Len(t, loaded.sstables[0], 1)
+	assert.Equal(t, live.Name, loaded.sstables[0][0].Name)
+	assert.Equal(t, "a", loaded.sstables[0][0].MinKey)
+	assert.Equal(t, "b", loaded.sstables[0][0].MaxKey)
+	assert.Equal(t, uint64(2), loaded.LastSequence())
+
+	_, err := os.Stat(orphan.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Numbering continues past the orphan
+	assert.Equal(t, "0003", loaded.NewSSTable(cfg, 0).Name)
+}
+
+func TestSSTableManagerFindFallsThroughBloomFalsePositive(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000}
+	manager := NewSSTableManager(cfg)
+
+	older, _ := NewFromKVPairs("a:old,b:2")
+	newer, _ := NewFromKVPairs("a:new,c:3")
+	newest, _ := NewFromKVPairs("d:4")
+	assert.NoError(t, manager.Flush(manager.AddSSTable(cfg), older))
+	assert.NoError(t, manager.Flush(manager.AddSSTable(cfg), newer))
+	falsePositive := manager.AddSSTable(cfg)
+	assert.NoError(t, manager.Flush(falsePositive, newest))
+
+	// Make the newest table's bloom filter claim every key
+	falsePositive.BloomFilter.Add("b")
+	falsePositive.BloomFilter.Add("c")
+	falsePositive.MinKey = "a"
+
+	record, sstable, err := manager.Find("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "0001", sstable.Name)
+	assert.Equal(t, DBRecordValue("2"), record.Value)
+
+	record, sstable, err = manager.Find("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "0002", sstable.Name)
+	assert.Equal(t, DBRecordValue("3"), record.Value)
+
+	record, _, err = manager.Find("a")
+	assert.NoError(t, err)
+	assert.Equal(t, DBRecordValue("new"), record.Value)
+
+	record, sstable, err = manager.Find("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+	assert.Nil(t, sstable)
+}
+
+func TestSSTableManagerCandidatesAcrossLevels(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000}
+	manager := NewSSTableManager(cfg)
+
+	addTable := func(level int, minKey, maxKey string) *SSTable {
+		sstable := addTestTable(manager, cfg, level, minKey, maxKey, 0)
+		sstable.BloomFilter.Add("k")
+		return sstable
+	}
+
+	l0Old := addTable(0, "a", "z")
+	addTable(0, "a", "f") // Key range rules the key out
+	l0New := addTable(0, "h", "m")
+	addTable(1, "a", "f")
+	l1 := addTable(1, "g", "p")
+	addTable(1, "q", "z")
+	l2 := addTable(2, "k", "k")
+	addTable(3, "l", "z")
+
+	assert.Equal(t, []*SSTable{l0New, l0Old, l1, l2}, manager.candidates("k"))
+}
+
+func TestSSTableBlocks(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000, sstableBlockSize: 128}
+	manager := NewSSTableManager(cfg)
+
+	// Every other key has three versions, which must stay in one block
+	var records []DBRecord
+	for i := range 40 {
+		key := DBRecordKey(fmt.Sprintf("key_%02d", i))
+		versions := 1
+		if i%2 == 0 {
+			versions = 3
+		}
+		for v := versions; v > 0; v-- {
+			records = append(records, DBRecord{Key: key, Value: DBRecordValue(fmt.Sprint(v)), SeqNumber: uint64(100*i + v)})
+		}
+	}
+
+	sstable := manager.AddSSTable(cfg)
+	assert.NoError(t, manager.WriteRecords(sstable, records))
+
+	blocks := len(sstable.SparseIndex.Index)
+	assert.Greater(t, blocks, 1)
+	assert.Less(t, blocks, 40, "the index holds a key per block, not per key")
+
+	for i := range 40 {
+		key := fmt.Sprintf("key_%02d", i)
+
+		record, err := manager.Read(sstable, key)
+		assert.NoError(t, err)
+		if i%2 == 0 {
+			assert.Equal(t, DBRecordValue("3"), record.Value, key)
+
+			// The oldest version is read from the same block
+			record, err = manager.ReadAt(sstable, key, uint64(100*i+1))
+			assert.NoError(t, err)
+			assert.Equal(t, DBRecordValue("1"), record.Value, key)
+		} else {
+			assert.Equal(t, DBRecordValue("1"), record.Value, key)
+		}
+
+		_, err = manager.Read(sstable, key+"_missing")
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+
+	for _, key := range []string{"a", "key_", "z"} {
+		_, err := manager.Read(sstable, key)
+		assert.ErrorIs(t, err, ErrKeyNotFound, key)
+	}
+
+	// Without a MANIFEST the key range is recovered from the blocks
+	loaded := NewSSTableManager(cfg)
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, "key_00", loaded.sstables[0][0].MinKey)
+	assert.Equal(t, "key_39", loaded.sstables[0][0].MaxKey)
+
+	record, err := loaded.Read(loaded.sstables[0][0], "key_21")
+	assert.NoError(t, err)
+	assert.Equal(t, DBRecordValue("1"), record.Value)
+}
+
+func TestSSTableKeysWithSeparators(t *testing.T) {
+	// A tiny block size puts every key in the index
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000, sstableBlockSize: 1}
+	manager := NewSSTableManager(cfg)
+
+	keys := []string{"https://example.com/a?b=1,2", "tenant:user", "tenant:user,2"}
+	var records []DBRecord
+	for _, key := range keys {
+		records = append(records, DBRecord{Key: DBRecordKey(key), Value: DBRecordValue("value " + key)})
+	}
+	assert.NoError(t, manager.WriteRecords(manager.AddSSTable(cfg), records))
+
+	loaded := NewSSTableManager(cfg)
+	assert.NoError(t, loaded.Load())
+	sstable := loaded.sstables[0][0]
+	assert.Len(t, sstable.SparseIndex.Index, len(keys))
+	assert.Equal(t, keys[len(keys)-1], sstable.MaxKey)
+
+	for _, key := range keys {
+		record, err := loaded.Read(sstable, key)
+		assert.NoError(t, err, key)
+		assert.Equal(t, DBRecordValue("value "+key), record.Value)
+	}
+}
+
+func TestSSTableBloomFilterSizedByKeys(t *testing.T) {
+	var records []DBRecord
+	for i := range 50 {
+		key := DBRecordKey(fmt.Sprintf("key_%02d", i))
+		// Versions of a key count once
+		records = append(records, DBRecord{Key: key, SeqNumber: 2}, DBRecord{Key: key, SeqNumber: 1})
+	}
+
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), bloomBitsPerKey: 16}
+	manager := NewSSTableManager(cfg)
+	sstable := manager.AddSSTable(cfg)
+	assert.NoError(t, manager.WriteRecords(sstable, records))
+	assert.Equal(t, 50*16, sstable.BloomFilter.Size())
+	assert.True(t, sstable.BloomFilter.Contains("key_07"))
+
+	loaded := NewSSTableManager(cfg)
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, 50*16, loaded.sstables[0][0].BloomFilter.Size())
+	assert.True(t, loaded.sstables[0][0].BloomFilter.Contains("key_07"))
+
+	// A fixed size overrides the sizing by key count
+	cfg = &LSMTStorageConfig{outputDir: t.TempDir(), sstableBloomFilterSize: 1000, bloomBitsPerKey: 16}
+	manager = NewSSTableManager(cfg)
+	sstable = manager.AddSSTable(cfg)
+	assert.NoError(t, manager.WriteRecords(sstable, records))
+	assert.Equal(t, 1000, sstable.BloomFilter.Size())
+}
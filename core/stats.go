@@ -0,0 +1,46 @@
+package core
+
+// Stats is a point in time view of the memory and disk usage of the storage.
+type Stats struct {
+	SeqNumber uint64
+	// Active memtable
+	MemTableEntries int
+	MemTableBytes   int
+	// Full memtables waiting for the background flush
+	ImmutableMemTables     int
+	ImmutableMemTableBytes int
+	// Indexed by level, down to the deepest level holding tables
+	Levels    []LevelStats
+	Snapshots int
+}
+
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+}
+
+func (s *LSMTStorage) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{
+		SeqNumber:          s.seqNumber,
+		MemTableEntries:    s.memTable.Size(),
+		MemTableBytes:      s.memTable.ApproximateSize(),
+		ImmutableMemTables: len(s.immutables),
+	}
+	for _, imm := range s.immutables {
+		stats.ImmutableMemTableBytes += imm.memTable.ApproximateSize()
+	}
+	for level := 0; level <= s.ssTableManager.MaxLevel(); level++ {
+		stats.Levels = append(stats.Levels, LevelStats{
+			Tables: len(s.ssTableManager.Tables(level)),
+			Bytes:  s.ssTableManager.levelSize(level),
+		})
+	}
+	for _, count := range s.snapshots {
+		stats.Snapshots += count
+	}
+
+	return stats
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The tests below are meant to be run with -race. Small memtables keep
+// flushes and compactions running while the clients are busy.
+
+func newStressTestStorage(t *testing.T) *LSMTStorage {
+	return newCompactionTestStorage(
+		t,
+		t.TempDir(),
+		WithMemtableThreshold(16),
+		WithL0CompactionTrigger(2),
+		WithLevelSizeBase(4*KB),
+		WithTargetFileSize(1*KB),
+	)
+}
+
+func TestStressConcurrentReadersAndWriters(t *testing.T) {
+	db := newStressTestStorage(t)
+
+	const writers = 4
+	const writes = 100
+
+	// Writes of each writer that completed so far
+	var progress [writers]atomic.Int64
+	var wg sync.WaitGroup
+
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				key := fmt.Sprintf("w%d-%04d", w, i)
+				assert.NoError(t, db.Write(key, []byte(strconv.Itoa(i))))
+				progress[w].Store(int64(i + 1))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			random := rand.New(rand.NewSource(int64(r)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// A completed write is visible, wherever it is on its way
+				// from the memtable to the levels
+				w := random.Intn(writers)
+				written := progress[w].Load()
+				if written == 0 {
+					continue
+				}
+				i := random.Int63n(written)
+				value, err := db.Read(fmt.Sprintf("w%d-%04d", w, i))
+				if assert.NoError(t, err) {
+					assert.Equal(t, strconv.FormatInt(i, 10), string(value))
+				}
+
+				if random.Intn(20) == 0 {
+					results, err := db.ScanPrefix(fmt.Sprintf("w%d-", w))
+					assert.NoError(t, err)
+					assert.GreaterOrEqual(t, len(results), int(written))
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	count := 0
+	for range db.Iter {
+		count++
+	}
+	assert.Equal(t, writers*writes, count)
+}
+
+func TestStressConcurrentTransfers(t *testing.T) {
+	db := newStressTestStorage(t)
+
+	const accounts = 5
+	const initial = 100
+	for a := range accounts {
+		assert.NoError(t, db.Write(fmt.Sprintf("account%d", a), []byte(strconv.Itoa(initial))))
+	}
+
+	balance := func(txn *Txn, account string) int {
+		value, err := txn.Get(account)
+		assert.NoError(t, err)
+		n, err := strconv.Atoi(string(value))
+		assert.NoError(t, err)
+		return n
+	}
+
+	var wg sync.WaitGroup
+	for c := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(c)))
+			for range 50 {
+				from := fmt.Sprintf("account%d", random.Intn(accounts))
+				to := fmt.Sprintf("account%d", random.Intn(accounts))
+				if from == to {
+					continue
+				}
+
+				// Retry until the transfer commits without a conflict
+				for {
+					txn := db.Begin()
+					fromBalance, toBalance := balance(txn, from), balance(txn, to)
+					assert.NoError(t, txn.Put(from, []byte(strconv.Itoa(fromBalance-1))))
+					assert.NoError(t, txn.Put(to, []byte(strconv.Itoa(toBalance+1))))
+
+					err := txn.Commit()
+					if errors.Is(err, ErrTxnConflict) {
+						continue
+					}
+					assert.NoError(t, err)
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Money was only ever moved, never lost or created
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+	results, err := snapshot.ScanPrefix("account")
+	assert.NoError(t, err)
+
+	total := 0
+	for _, result := range results {
+		n, err := strconv.Atoi(string(result.Value))
+		assert.NoError(t, err)
+		total += n
+	}
+	assert.Equal(t, accounts*initial, total)
+}
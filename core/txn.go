@@ -0,0 +1,134 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTxnConflict = errors.New("transaction conflict")
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn is an optimistic read-modify-write transaction. Reads see the database
+// as of Begin plus the transaction's own writes, which are buffered until
+// Commit. Commit fails with ErrTxnConflict when a key the transaction read
+// was written by someone else in the meantime, so a committed transaction
+// behaves as if it ran alone at its commit point.
+type Txn struct {
+	db       *LSMTStorage
+	snapshot *Snapshot
+	writes   *WriteBatch
+	written  map[string]WALRecord // Last buffered write of each key
+	reads    map[string]struct{}
+	done     bool
+}
+
+// Begin starts a transaction. It must end with Commit or Rollback, as it
+// holds a snapshot until then.
+func (s *LSMTStorage) Begin() *Txn {
+	return &Txn{
+		db:       s,
+		snapshot: s.Snapshot(),
+		writes:   NewWriteBatch(),
+		written:  make(map[string]WALRecord),
+		reads:    make(map[string]struct{}),
+	}
+}
+
+// Get returns the value of key, including the transaction's own writes. The
+// key is checked for conflicts at commit, whether it was found or not.
+func (t *Txn) Get(key string) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	if record, ok := t.written[key]; ok {
+		if record.Type == WALRecordDelete {
+			return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+		}
+		return record.Value, nil
+	}
+
+	t.reads[key] = struct{}{}
+	return t.snapshot.Read(key)
+}
+
+func (t *Txn) Put(key string, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if len(value) > MAX_SCALAR_SIZE {
+		return fmt.Errorf("value size exceeds maximum allowed size of %d bytes", MAX_SCALAR_SIZE)
+	}
+
+	t.writes.Put(key, value)
+	t.written[key] = WALRecord{Type: WALRecordPut, Key: DBRecordKey(key), Value: value}
+	return nil
+}
+
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.writes.Delete(key)
+	t.written[key] = WALRecord{Type: WALRecordDelete, Key: DBRecordKey(key)}
+	return nil
+}
+
+// Commit writes the buffered writes atomically, unless a key read by the
+// transaction changed after Begin. The transaction is over either way.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	defer t.Rollback()
+
+	if t.writes.Len() == 0 {
+		return nil
+	}
+
+	db := t.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key := range t.reads {
+		seqNumber, err := db.lastSeqNumber(key)
+		if err != nil {
+			return err
+		}
+		if seqNumber > t.snapshot.seqNumber {
+			return fmt.Errorf("%w: %s changed after the transaction started", ErrTxnConflict, key)
+		}
+	}
+
+	return db.writeLocked(WALRecord{
+		Type:  WALRecordBatch,
+		Batch: t.writes.ops,
+	})
+}
+
+// Rollback discards the buffered writes. Rolling back a finished transaction
+// is a no-op.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.snapshot.Release()
+}
+
+// lastSeqNumber returns the sequence number of the newest version of key,
+// tombstones included, or 0 if there is none. s.mu must be held.
+func (s *LSMTStorage) lastSeqNumber(key string) (uint64, error) {
+	for _, memTable := range s.memTables() {
+		if node := memTable.Get(key); node != nil {
+			return node.Metadata.SeqNumber, nil
+		}
+	}
+
+	record, _, err := s.ssTableManager.Find(key)
+	if err != nil || record == nil {
+		return 0, err
+	}
+	return record.SeqNumber, nil
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnCommit(t *testing.T) {
+	db := NewLSMTStorage(WithOutDir(t.TempDir()), WithMemtableThreshold(10))
+	db.Write("alice", []byte("100"))
+	db.Write("bob", []byte("50"))
+
+	txn := db.Begin()
+	value, err := txn.Get("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("100"), value)
+
+	assert.NoError(t, txn.Put("alice", []byte("70")))
+	assert.NoError(t, txn.Put("bob", []byte("80")))
+	assert.NoError(t, txn.Delete("carol"))
+
+	// Own writes are visible to the transaction only
+	value, err = txn.Get("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("70"), value)
+	_, err = txn.Get("carol")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	value, err = db.Read("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("100"), value)
+
+	// Writes to keys the transaction did not read do not conflict
+	db.Write("dave", []byte("10"))
+
+	assert.NoError(t, txn.Commit())
+	assert.Empty(t, db.snapshots)
+
+	value, err = db.Read("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("70"), value)
+	value, err = db.Read("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("80"), value)
+
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	assert.ErrorIs(t, txn.Put("alice", []byte("0")), ErrTxnDone)
+}
+
+func TestTxnConflict(t *testing.T) {
+	tempDir := t.TempDir()
+	db := NewLSMTStorage(WithOutDir(tempDir), WithMemtableThreshold(2))
+	t.Cleanup(func() { db.waitForFlushes() })
+	db.Write("alice", []byte("100"))
+
+	first := db.Begin()
+	second := db.Begin()
+
+	for _, txn := range []*Txn{first, second} {
+		value, err := txn.Get("alice")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("100"), value)
+		_, err = txn.Get("missing")
+		assert.Error(t, err)
+	}
+
+	assert.NoError(t, first.Put("alice", []byte("90")))
+	assert.NoError(t, first.Commit())
+
+	// The first commit is flushed, so the conflict is found in an SSTable
+	assert.NoError(t, db.waitForFlushes())
+	assert.NoError(t, second.Put("alice", []byte("80")))
+	assert.ErrorIs(t, second.Commit(), ErrTxnConflict)
+
+	value, err := db.Read("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("90"), value)
+
+	// A key read while missing conflicts once it is created
+	third := db.Begin()
+	_, err = third.Get("missing")
+	assert.Error(t, err)
+	db.Write("missing", []byte("found"))
+	assert.NoError(t, third.Put("other", []byte("value")))
+	assert.ErrorIs(t, third.Commit(), ErrTxnConflict)
+	_, err = db.Read("other")
+	assert.Error(t, err)
+}
+
+func TestTxnRollback(t *testing.T) {
+	db := NewLSMTStorage(WithOutDir(t.TempDir()), WithMemtableThreshold(10))
+
+	txn := db.Begin()
+	assert.NoError(t, txn.Put("a", []byte("value_a")))
+	txn.Rollback()
+	txn.Rollback()
+
+	_, err := db.Read("a")
+	assert.Error(t, err)
+	assert.Empty(t, db.snapshots)
+	_, err = txn.Get("a")
+	assert.ErrorIs(t, err, ErrTxnDone)
+}
@@ -1,20 +1,380 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogioldat/ttrunksdb/internal"
+)
+
+const WAL_SEGMENT_EXT = ".log"
+
+// WALSyncMode decides when records appended to the WAL are fsynced, trading
+// durability of acknowledged writes for write throughput.
+type WALSyncMode int
+
+const (
+	// WALSyncAlways fsyncs after every record.
+	WALSyncAlways WALSyncMode = iota
+	// WALSyncGroup fsyncs once the configured number of bytes is pending.
+	WALSyncGroup
+	// WALSyncInterval fsyncs pending records periodically in the background.
+	WALSyncInterval
+	// WALSyncNone never fsyncs and leaves flushing to the OS, e.g. for bulk loads.
+	WALSyncNone
 )
 
+const DEFAULT_WAL_SYNC_INTERVAL = 100 * time.Millisecond
+const DEFAULT_WAL_SYNC_BYTES = 1 * MB
+
+var walSyncModeNames = map[WALSyncMode]string{
+	WALSyncAlways:   "always",
+	WALSyncGroup:    "group",
+	WALSyncInterval: "interval",
+	WALSyncNone:     "none",
+}
+
+func (m WALSyncMode) String() string {
+	if name, ok := walSyncModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("WALSyncMode(%d)", int(m))
+}
+
+func ParseWALSyncMode(name string) (WALSyncMode, error) {
+	for mode, modeName := range walSyncModeNames {
+		if modeName == strings.ToLower(name) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown WAL sync mode: %s", name)
+}
+
+// ErrWALFailed is returned by every write once a failed write to the WAL could
+// not be undone.
+var ErrWALFailed = errors.New("WAL unusable after failed write")
+
+// logFile is the part of *os.File the WAL and the MANIFEST append through.
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// WAL is split into numbered segments. A new segment is started every time
+// the memtable is swapped out for flushing, so that a segment can be released
+// as soon as the SSTable holding its records is durably on disk.
 type WAL struct {
-	file      *os.File
-	outputDir string
+	mu           sync.Mutex
+	file         logFile
+	size         int64 // Bytes of whole records in the current segment
+	err          error // Set once the current segment holds a partial record
+	outputDir    string
+	archiveDir   string
+	segment      uint64
+	syncMode     WALSyncMode
+	syncBytes    int
+	unsyncedSize int
+	stopSync     chan struct{}
+	syncDone     chan struct{}
+}
+
+func (w *WAL) SegmentPath(segment uint64) string {
+	return path.Join(w.outputDir, fmt.Sprintf("%06d%s", segment, WAL_SEGMENT_EXT))
+}
+
+func (w *WAL) Log(record WALRecord) error {
+	entry, err := record.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if _, err := w.file.Write(entry); err != nil {
+		// Replay stops at a partial record, which would hide every record
+		// appended after it, so cut it off before acknowledging any more
+		if truncateErr := w.file.Truncate(w.size); truncateErr != nil {
+			w.err = fmt.Errorf("%w: %w", ErrWALFailed, errors.Join(err, truncateErr))
+			return w.err
+		}
+		return err
+	}
+	w.size += int64(len(entry))
+	w.unsyncedSize += len(entry)
+
+	switch w.syncMode {
+	case WALSyncAlways:
+		return w.sync()
+	case WALSyncGroup:
+		if w.unsyncedSize >= w.syncBytes {
+			return w.sync()
+		}
+	}
+
+	return nil
+}
+
+// Sync fsyncs every record logged so far, whatever the sync mode.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sync()
+}
+
+func (w *WAL) sync() error {
+	if w.unsyncedSize == 0 {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unsyncedSize = 0
+	return nil
+}
+
+func (w *WAL) syncPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(w.syncDone)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				internal.Logger.Error("WAL sync failed", "err", err)
+			}
+		case <-w.stopSync:
+			return
+		}
+	}
+}
+
+// Close stops background syncing, fsyncs pending records and closes the
+// current segment.
+func (w *WAL) Close() error {
+	if w.stopSync != nil {
+		close(w.stopSync)
+		<-w.syncDone
+		w.stopSync = nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// Replay calls apply for every complete record in the log, oldest segment
+// first. A torn or corrupt record in the newest segment (e.g. one left by a
+// crash mid-write) ends the log: the segment is cut there, so that new
+// records are appended right after the last valid one. Older segments were
+// complete when the next one was started, so corruption in one of them is a
+// hole in the history and fails the replay with a *WALCorruptionError.
+func (w *WAL) Replay(apply func(record *WALRecord) error) (int, error) {
+	segments, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for i, segment := range segments {
+		n, err := w.replaySegment(segment, i == len(segments)-1, apply)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+
+	return replayed, nil
+}
+
+func (w *WAL) replaySegment(segment uint64, newest bool, apply func(record *WALRecord) error) (int, error) {
+	file, err := os.OpenFile(w.SegmentPath(segment), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := NewWALReader(file)
+	replayed := 0
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		var corruption *WALCorruptionError
+		if errors.As(err, &corruption) && !newest {
+			return replayed, fmt.Errorf("WAL segment %d: %w", segment, err)
+		}
+		if errors.As(err, &corruption) {
+			internal.Logger.Warn(
+				"Discarding WAL tail",
+				"segment", segment,
+				"offset", corruption.Offset,
+				"reason", corruption.Reason,
+			)
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		if err := apply(record); err != nil {
+			return replayed, err
+		}
+
+		replayed++
+	}
+
+	if err := file.Truncate(reader.Offset()); err != nil {
+		return replayed, err
+	}
+
+	w.mu.Lock()
+	if segment == w.segment {
+		w.size = reader.Offset()
+	}
+	w.mu.Unlock()
+
+	return replayed, nil
+}
+
+// Rotate closes the current segment and starts a new one. It returns the
+// number of the closed segment, which holds every record logged so far.
+func (w *WAL) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The partial record has to stay the tail of the newest segment
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.syncMode != WALSyncNone {
+		if err := w.sync(); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+
+	closed := w.segment
+	if err := w.openSegment(closed + 1); err != nil {
+		return 0, err
+	}
+
+	return closed, nil
 }
 
-func (w *WAL) Log(key, value string) error {
-	entry := fmt.Sprintf("%s:%s\n", key, value)
-	_, err := w.file.WriteString(entry)
-	return err
+// Release removes every segment up to and including the given one, or
+// moves it to the archive directory when one is configured. It must only be
+// called once the records of those segments are durably stored elsewhere.
+func (w *WAL) Release(upTo uint64) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	current := w.segment
+	w.mu.Unlock()
+
+	if w.archiveDir != "" {
+		if err := os.MkdirAll(w.archiveDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, segment := range segments {
+		if segment > upTo || segment == current {
+			continue
+		}
+
+		segmentPath := w.SegmentPath(segment)
+		if w.archiveDir != "" {
+			err = os.Rename(segmentPath, path.Join(w.archiveDir, path.Base(segmentPath)))
+		} else {
+			err = os.Remove(segmentPath)
+		}
+		if err != nil {
+			return err
+		}
+
+		internal.Logger.Debug("WAL segment released", "segment", segment, "archived", w.archiveDir != "")
+	}
+
+	return syncDir(w.outputDir)
+}
+
+func (w *WAL) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), WAL_SEGMENT_EXT)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		segment, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+
+	slices.Sort(segments)
+	return segments, nil
+}
+
+func (w *WAL) openSegment(segment uint64) error {
+	file, err := os.OpenFile(w.SegmentPath(segment), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.segment = segment
+	w.unsyncedSize = 0
+	return syncDir(w.outputDir)
+}
+
+// syncDir makes file creations, renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func NewWAL(config *LSMTStorageConfig) (*WAL, error) {
@@ -22,10 +382,34 @@ func NewWAL(config *LSMTStorageConfig) (*WAL, error) {
 	if err := os.MkdirAll(walDir, 0755); err != nil {
 		return nil, err
 	}
-	walPath := path.Join(walDir, "wal.log")
-	file, err := os.Create(walPath)
+
+	wal := &WAL{
+		outputDir:  walDir,
+		archiveDir: config.walArchiveDir,
+		syncMode:   config.walSyncMode,
+		syncBytes:  config.walSyncBytes,
+	}
+
+	segments, err := wal.segments()
 	if err != nil {
 		return nil, err
 	}
-	return &WAL{file: file, outputDir: walDir}, nil
+
+	// Keep appending to the newest segment, it is not covered by any SSTable yet
+	segment := uint64(1)
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1]
+	}
+
+	if err := wal.openSegment(segment); err != nil {
+		return nil, err
+	}
+
+	if wal.syncMode == WALSyncInterval {
+		wal.stopSync = make(chan struct{})
+		wal.syncDone = make(chan struct{})
+		go wal.syncPeriodically(config.walSyncInterval)
+	}
+
+	return wal, nil
 }
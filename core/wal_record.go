@@ -0,0 +1,323 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+type WALRecordType uint8
+
+const (
+	WALRecordPut WALRecordType = iota + 1
+	WALRecordDelete
+	WALRecordBatch
+)
+
+// WALRecord is a single entry of the write-ahead log. Batch records carry
+// their operations in Batch; the n-th operation has sequence SeqNumber+n.
+type WALRecord struct {
+	Type      WALRecordType
+	SeqNumber uint64
+	Timestamp DBRecordTimestamp
+	Key       DBRecordKey
+	Value     DBRecordValue
+	Batch     []WALRecord
+}
+
+// Ops returns the puts and deletes of the record with their sequence numbers
+// and timestamps filled in: the operations of a batch, or the record itself.
+func (r WALRecord) Ops() []WALRecord {
+	if r.Type != WALRecordBatch {
+		return []WALRecord{r}
+	}
+
+	ops := make([]WALRecord, len(r.Batch))
+	for i, op := range r.Batch {
+		op.SeqNumber = r.SeqNumber + uint64(i)
+		op.Timestamp = r.Timestamp
+		ops[i] = op
+	}
+	return ops
+}
+
+// DBRecord returns the memtable record of a put or delete.
+func (r WALRecord) DBRecord() DBRecord {
+	return DBRecord{
+		Key:       r.Key,
+		Value:     r.Value,
+		Timestamp: r.Timestamp,
+		Tombstone: DBRecordTombstone(r.Type == WALRecordDelete),
+		SeqNumber: r.SeqNumber,
+	}
+}
+
+const WAL_RECORD_CHECKSUM_BYTES = 4
+const WAL_RECORD_LENGTH_BYTES = 4
+const WAL_RECORD_HEADER_BYTES = WAL_RECORD_CHECKSUM_BYTES + WAL_RECORD_LENGTH_BYTES
+const WAL_MAX_RECORD_SIZE = 64 * MB
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WALCorruptionError is returned by WALReader when the record starting at
+// Offset is torn or does not match its checksum.
+type WALCorruptionError struct {
+	Offset int64
+	Reason string
+}
+
+func (e *WALCorruptionError) Error() string {
+	return fmt.Sprintf("corrupted WAL record at offset %d: %s", e.Offset, e.Reason)
+}
+
+func writeWALOp(buf *bytes.Buffer, key DBRecordKey, value DBRecordValue) error {
+	if err := binary.Write(buf, BYTES_ORDER, DBRecordKeySize(len(key))); err != nil {
+		return err
+	}
+	if _, err := buf.WriteString(string(key)); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, BYTES_ORDER, DBRecordValueSize(len(value))); err != nil {
+		return err
+	}
+	_, err := buf.Write(value)
+	return err
+}
+
+func readWALOp(reader io.Reader) (DBRecordKey, DBRecordValue, error) {
+	var keySize DBRecordKeySize
+	var valueSize DBRecordValueSize
+
+	if err := binary.Read(reader, BYTES_ORDER, &keySize); err != nil {
+		return "", nil, err
+	}
+	if keySize < 0 {
+		return "", nil, fmt.Errorf("invalid key size: %d", keySize)
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return "", nil, err
+	}
+	if err := binary.Read(reader, BYTES_ORDER, &valueSize); err != nil {
+		return "", nil, err
+	}
+	if valueSize < 0 {
+		return "", nil, fmt.Errorf("invalid value size: %d", valueSize)
+	}
+	value := make([]byte, valueSize)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return "", nil, err
+	}
+
+	return DBRecordKey(key), DBRecordValue(value), nil
+}
+
+// MarshalBinary encodes the record together with its checksum and length
+// prefix, ready to be appended to the log.
+func (r *WALRecord) MarshalBinary() ([]byte, error) {
+	payload := new(bytes.Buffer)
+
+	if err := binary.Write(payload, BYTES_ORDER, r.Type); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(payload, BYTES_ORDER, r.SeqNumber); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(payload, BYTES_ORDER, r.Timestamp); err != nil {
+		return nil, err
+	}
+
+	switch r.Type {
+	case WALRecordPut, WALRecordDelete:
+		if err := writeWALOp(payload, r.Key, r.Value); err != nil {
+			return nil, err
+		}
+	case WALRecordBatch:
+		if err := binary.Write(payload, BYTES_ORDER, uint32(len(r.Batch))); err != nil {
+			return nil, err
+		}
+		for _, op := range r.Batch {
+			if err := binary.Write(payload, BYTES_ORDER, op.Type); err != nil {
+				return nil, err
+			}
+			if err := writeWALOp(payload, op.Key, op.Value); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown WAL record type: %d", r.Type)
+	}
+
+	return encodeFrame(payload.Bytes())
+}
+
+// encodeFrame prefixes payload with its checksum and length. Frames are the
+// unit of both the WAL and the MANIFEST.
+func encodeFrame(payload []byte) ([]byte, error) {
+	if len(payload) > WAL_MAX_RECORD_SIZE {
+		return nil, fmt.Errorf("record size exceeds maximum allowed size of %d bytes", WAL_MAX_RECORD_SIZE)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(WAL_RECORD_HEADER_BYTES + len(payload))
+
+	if err := binary.Write(buf, BYTES_ORDER, crc32.Checksum(payload, walChecksumTable)); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, BYTES_ORDER, uint32(len(payload))); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(payload); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func unmarshalWALPayload(payload []byte) (*WALRecord, error) {
+	reader := bytes.NewReader(payload)
+	record := &WALRecord{}
+
+	if err := binary.Read(reader, BYTES_ORDER, &record.Type); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, BYTES_ORDER, &record.SeqNumber); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, BYTES_ORDER, &record.Timestamp); err != nil {
+		return nil, err
+	}
+
+	switch record.Type {
+	case WALRecordPut, WALRecordDelete:
+		key, value, err := readWALOp(reader)
+		if err != nil {
+			return nil, err
+		}
+		record.Key = key
+		record.Value = value
+	case WALRecordBatch:
+		var count uint32
+		if err := binary.Read(reader, BYTES_ORDER, &count); err != nil {
+			return nil, err
+		}
+		for i := range count {
+			op := WALRecord{
+				SeqNumber: record.SeqNumber + uint64(i),
+				Timestamp: record.Timestamp,
+			}
+			if err := binary.Read(reader, BYTES_ORDER, &op.Type); err != nil {
+				return nil, err
+			}
+			if op.Type != WALRecordPut && op.Type != WALRecordDelete {
+				return nil, fmt.Errorf("invalid batch operation type: %d", op.Type)
+			}
+			key, value, err := readWALOp(reader)
+			if err != nil {
+				return nil, err
+			}
+			op.Key = key
+			op.Value = value
+			record.Batch = append(record.Batch, op)
+		}
+	default:
+		return nil, fmt.Errorf("unknown WAL record type: %d", record.Type)
+	}
+
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", reader.Len())
+	}
+
+	return record, nil
+}
+
+// frameReader reads checksummed frames written by encodeFrame.
+type frameReader struct {
+	reader *bufio.Reader
+	offset int64
+	end    int64 // End of the frame read last, as its header claims
+}
+
+// next reads the next frame and hands its payload to decode. The frame only
+// counts as read when decode succeeds; otherwise it is reported as corrupt.
+func (r *frameReader) next(decode func(payload []byte) error) error {
+	header := make([]byte, WAL_RECORD_HEADER_BYTES)
+	n, err := io.ReadFull(r.reader, header)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		r.end = r.offset + int64(WAL_RECORD_HEADER_BYTES)
+		return r.corrupted(fmt.Sprintf("torn header (%d of %d bytes)", n, WAL_RECORD_HEADER_BYTES))
+	}
+	if err != nil {
+		return err
+	}
+
+	checksum := BYTES_ORDER.Uint32(header[:WAL_RECORD_CHECKSUM_BYTES])
+	length := BYTES_ORDER.Uint32(header[WAL_RECORD_CHECKSUM_BYTES:])
+	r.end = r.offset + int64(WAL_RECORD_HEADER_BYTES) + int64(length)
+	if length > WAL_MAX_RECORD_SIZE {
+		return r.corrupted(fmt.Sprintf("invalid record length %d", length))
+	}
+
+	payload := make([]byte, length)
+	n, err = io.ReadFull(r.reader, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return r.corrupted(fmt.Sprintf("torn payload (%d of %d bytes)", n, length))
+	}
+	if err != nil {
+		return err
+	}
+	if crc32.Checksum(payload, walChecksumTable) != checksum {
+		return r.corrupted("checksum mismatch")
+	}
+
+	if err := decode(payload); err != nil {
+		return r.corrupted(err.Error())
+	}
+
+	r.offset += int64(WAL_RECORD_HEADER_BYTES) + int64(length)
+
+	return nil
+}
+
+func (r *frameReader) corrupted(reason string) error {
+	return &WALCorruptionError{Offset: r.offset, Reason: reason}
+}
+
+// WALReader decodes records from a log, one at a time.
+type WALReader struct {
+	frames frameReader
+}
+
+func NewWALReader(reader io.Reader) *WALReader {
+	return &WALReader{frames: frameReader{reader: bufio.NewReader(reader)}}
+}
+
+// Offset returns the position right after the last record that was read
+// successfully, which is also where a corrupt record begins.
+func (r *WALReader) Offset() int64 {
+	return r.frames.offset
+}
+
+// Next returns the next record of the log. It returns io.EOF once the log
+// ends cleanly and a *WALCorruptionError when the next record is torn or
+// damaged; no records are returned past the first corrupt one.
+func (r *WALReader) Next() (*WALRecord, error) {
+	var record *WALRecord
+
+	err := r.frames.next(func(payload []byte) error {
+		var err error
+		record, err = unmarshalWALPayload(payload)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
@@ -0,0 +1,393 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func putRecord(seq uint64, key, value string) WALRecord {
+	return WALRecord{
+		Type:      WALRecordPut,
+		SeqNumber: seq,
+		Timestamp: DBRecordTimestamp(1751374012),
+		Key:       DBRecordKey(key),
+		Value:     DBRecordValue(value),
+	}
+}
+
+func replayAll(t *testing.T, wal *WAL) []WALRecord {
+	var records []WALRecord
+	_, err := wal.Replay(func(record *WALRecord) error {
+		records = append(records, *record)
+		return nil
+	})
+	assert.NoError(t, err)
+	return records
+}
+
+func TestWALRecordRoundTrip(t *testing.T) {
+	testCases := []WALRecord{
+		putRecord(1, "tenant:user", "value with\nnewlines\tand\x00null bytes"),
+		{
+			Type:      WALRecordDelete,
+			SeqNumber: 2,
+			Timestamp: DBRecordTimestamp(1751374012),
+			Key:       DBRecordKey("deleted"),
+			Value:     DBRecordValue{},
+		},
+		{
+			Type:      WALRecordBatch,
+			SeqNumber: 3,
+			Timestamp: DBRecordTimestamp(1751374012),
+			Batch: []WALRecord{
+				{Type: WALRecordPut, SeqNumber: 3, Timestamp: 1751374012, Key: "a", Value: DBRecordValue("1")},
+				{Type: WALRecordDelete, SeqNumber: 4, Timestamp: 1751374012, Key: "b", Value: DBRecordValue{}},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		encoded, err := testCase.MarshalBinary()
+		assert.NoError(t, err)
+
+		reader := NewWALReader(bytes.NewReader(encoded))
+		decoded, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, testCase, *decoded)
+		assert.Equal(t, int64(len(encoded)), reader.Offset())
+
+		_, err = reader.Next()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestWALReaderStopsAtCorruptRecord(t *testing.T) {
+	var log []byte
+	for i, key := range []string{"a", "b", "c"} {
+		record := putRecord(uint64(i+1), key, "value")
+		encoded, err := record.MarshalBinary()
+		assert.NoError(t, err)
+		log = append(log, encoded...)
+	}
+
+	recordSize := len(log) / 3
+	// Flip a byte in the value of the second record
+	log[2*recordSize-1] ^= 0xFF
+
+	reader := NewWALReader(bytes.NewReader(log))
+
+	record, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, DBRecordKey("a"), record.Key)
+
+	_, err = reader.Next()
+	var corruption *WALCorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, int64(recordSize), corruption.Offset)
+	assert.Equal(t, int64(recordSize), reader.Offset())
+}
+
+func TestWALReplay(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+	assert.NoError(t, wal.Log(putRecord(2, "b", "2")))
+
+	reopened, err := NewWAL(cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1"), putRecord(2, "b", "2")}, replayAll(t, reopened))
+}
+
+func TestWALReplayKeepsExistingEntries(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+
+	reopened, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	replayAll(t, reopened)
+	assert.NoError(t, reopened.Log(putRecord(2, "b", "2")))
+
+	final, err := NewWAL(cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1"), putRecord(2, "b", "2")}, replayAll(t, final))
+}
+
+func TestWALReplayTornEntry(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+
+	// Simulate a crash in the middle of writing the next entry
+	torn := putRecord(2, "b", "torn")
+	encoded, err := torn.MarshalBinary()
+	assert.NoError(t, err)
+	_, err = wal.file.Write(encoded[:len(encoded)-2])
+	assert.NoError(t, err)
+
+	reopened, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1")}, replayAll(t, reopened))
+
+	assert.NoError(t, reopened.Log(putRecord(2, "c", "3")))
+
+	content, err := os.ReadFile(reopened.SegmentPath(1))
+	assert.NoError(t, err)
+
+	var records []WALRecord
+	reader := NewWALReader(bytes.NewReader(content))
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		records = append(records, *record)
+	}
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1"), putRecord(2, "c", "3")}, records)
+}
+
+func TestWALReplayAcrossSegments(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+
+	closed, err := wal.Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), closed)
+	assert.NoError(t, wal.Log(putRecord(2, "b", "2")))
+
+	reopened, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), reopened.segment)
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1"), putRecord(2, "b", "2")}, replayAll(t, reopened))
+}
+
+func TestWALRelease(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(2, "b", "2")))
+	closed, err := wal.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(3, "c", "3")))
+
+	assert.NoError(t, wal.Release(closed))
+
+	segments, err := wal.segments()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3}, segments)
+	assert.Equal(t, []WALRecord{putRecord(3, "c", "3")}, replayAll(t, wal))
+}
+
+func TestWALReleaseToArchive(t *testing.T) {
+	archiveDir := path.Join(t.TempDir(), "archive")
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir(), walArchiveDir: archiveDir}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+	closed, err := wal.Rotate()
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Release(closed))
+
+	_, err = os.Stat(wal.SegmentPath(closed))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(archiveDir, path.Base(wal.SegmentPath(closed))))
+	assert.NoError(t, err)
+}
+
+func TestWALSyncModes(t *testing.T) {
+	testCases := []struct {
+		mode             WALSyncMode
+		expectedUnsynced func(size int) int
+	}{
+		{mode: WALSyncAlways, expectedUnsynced: func(size int) int { return 0 }},
+		{mode: WALSyncNone, expectedUnsynced: func(size int) int { return 2 * size }},
+		// The group threshold is crossed by the second record
+		{mode: WALSyncGroup, expectedUnsynced: func(size int) int { return 0 }},
+	}
+
+	record := putRecord(1, "a", "1")
+	encoded, err := record.MarshalBinary()
+	assert.NoError(t, err)
+	size := len(encoded)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.mode.String(), func(t *testing.T) {
+			cfg := &LSMTStorageConfig{
+				outputDir:    t.TempDir(),
+				walSyncMode:  testCase.mode,
+				walSyncBytes: size + 1,
+			}
+			wal, err := NewWAL(cfg)
+			assert.NoError(t, err)
+
+			assert.NoError(t, wal.Log(record))
+			assert.NoError(t, wal.Log(record))
+			assert.Equal(t, testCase.expectedUnsynced(size), wal.unsyncedSize)
+			assert.NoError(t, wal.Close())
+		})
+	}
+}
+
+func TestWALSyncGroupWaitsForThreshold(t *testing.T) {
+	cfg := &LSMTStorageConfig{
+		outputDir:    t.TempDir(),
+		walSyncMode:  WALSyncGroup,
+		walSyncBytes: 1 * KB,
+	}
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+	assert.Greater(t, wal.unsyncedSize, 0)
+
+	assert.NoError(t, wal.Sync())
+	assert.Equal(t, 0, wal.unsyncedSize)
+	assert.NoError(t, wal.Close())
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	cfg := &LSMTStorageConfig{
+		outputDir:       t.TempDir(),
+		walSyncMode:     WALSyncInterval,
+		walSyncInterval: 5 * time.Millisecond,
+	}
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+	assert.Eventually(t, func() bool {
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		return wal.unsyncedSize == 0
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, wal.Close())
+}
+
+func TestParseWALSyncMode(t *testing.T) {
+	for _, mode := range []WALSyncMode{WALSyncAlways, WALSyncGroup, WALSyncInterval, WALSyncNone} {
+		parsed, err := ParseWALSyncMode(mode.String())
+		assert.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	_, err := ParseWALSyncMode("sometimes")
+	assert.Error(t, err)
+}
+
+// failingLogFile writes only the first half of the next write and fails it.
+// When failTruncate is set, truncating fails too.
+type failingLogFile struct {
+	logFile
+	failNext     bool
+	failTruncate bool
+}
+
+func (f *failingLogFile) Write(p []byte) (int, error) {
+	if !f.failNext {
+		return f.logFile.Write(p)
+	}
+	f.failNext = false
+	n, _ := f.logFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *failingLogFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("read-only file system")
+	}
+	return f.logFile.Truncate(size)
+}
+
+func TestWALLogUndoesPartialWrite(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+
+	file := &failingLogFile{logFile: wal.file, failNext: true}
+	wal.file = file
+	assert.Error(t, wal.Log(putRecord(2, "b", "2")))
+
+	// Later records are appended right after the last whole one
+	assert.NoError(t, wal.Log(putRecord(3, "c", "3")))
+	assert.NoError(t, wal.Close())
+
+	reopened, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1"), putRecord(3, "c", "3")}, replayAll(t, reopened))
+}
+
+func TestWALLogFailsAfterUndoFails(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	wal.file = &failingLogFile{logFile: wal.file, failNext: true, failTruncate: true}
+
+	assert.ErrorIs(t, wal.Log(putRecord(1, "a", "1")), ErrWALFailed)
+	assert.ErrorIs(t, wal.Log(putRecord(2, "b", "2")), ErrWALFailed)
+	_, err = wal.Rotate()
+	assert.ErrorIs(t, err, ErrWALFailed)
+}
+
+func TestWALReplayFailsOnCorruptOlderSegment(t *testing.T) {
+	cfg := &LSMTStorageConfig{outputDir: t.TempDir()}
+
+	wal, err := NewWAL(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(1, "a", "1")))
+	assert.NoError(t, wal.Log(putRecord(2, "b", "2")))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Log(putRecord(3, "c", "3")))
+	assert.NoError(t, wal.Close())
+
+	// Damage the last record of the first segment
+	content, err := os.ReadFile(wal.SegmentPath(1))
+	assert.NoError(t, err)
+	content[len(content)-1] ^= 0xFF
+	assert.NoError(t, os.WriteFile(wal.SegmentPath(1), content, 0644))
+
+	reopened, err := NewWAL(cfg)
+	assert.NoError(t, err)
+
+	var records []WALRecord
+	_, err = reopened.Replay(func(record *WALRecord) error {
+		records = append(records, *record)
+		return nil
+	})
+	var corruption *WALCorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	// Nothing after the hole is applied, and the segment is left as it was
+	assert.Equal(t, []WALRecord{putRecord(1, "a", "1")}, records)
+	damaged, err := os.ReadFile(wal.SegmentPath(1))
+	assert.NoError(t, err)
+	assert.Equal(t, content, damaged)
+}